@@ -5,6 +5,7 @@
             :url "http://www.eclipse.org/legal/epl-v10.html"}
   :dependencies [[org.clojure/clojure "1.6.0"]
                  [org.clojure/core.async "0.1.303.0-886421-alpha"]
+                 [org.clojure/core.match "0.2.1"]
                  [instaparse "1.3.3"]
                  [jline "2.11"]
                  [org.clojure/tools.cli "0.3.1"]
@@ -21,5 +22,10 @@
                :main ^:skip-aot funcgo.main
                :target-path "target/%s"
              }
+             ;; --spec output needs clojure.spec, so load it in tests
+             ;; with:  lein with-profile +spec midje
+             :spec {:dependencies [[org.clojure/clojure "1.9.0"]]}
              :uberjar {:aot :all}}
+  :aliases {"anglxfmt" ["run" "-m" "anglx.fmt"]
+            "anglx-migrate" ["run" "-m" "anglx.migrate"]}
   :main anglx.main)
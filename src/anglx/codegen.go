@@ -15,6 +15,7 @@ package	 codegen
 import (
 	s     "clojure/string"
 	insta "instaparse/core"
+	"anglx/parser"
 	symbols "anglx/symboltable"
 )
 import type (
@@ -22,6 +23,9 @@ import type (
 	java.io.IOException
 )
 
+// The function that applies an update to each kind of mutable state.
+kStateUpdates := {"atom": "swap!", "ref": "alter", "agent": "send"}
+
 kAsyncRules := set{
 	ASYNCPREFIX,
 	CHAN,
@@ -35,6 +39,24 @@ kAsyncRules := set{
 	SELECTSTMTINGO
 }
 
+// Wrap the code generator for a rule whose node may end with a
+// docstring or annotations, so that it gets them merged into one map
+// with DOC and META keys as its first argument.
+func withDecorations(f) {
+	func(args...) {
+		decorations := isMap  takeWhile  reverse(args)
+		apply(f, reduce(merge, {}, decorations), dropLast(count(decorations), args))
+	}
+}
+
+// Put the prefix, if any, in front of the code that follows it.
+func prefixed(prefix, code) {
+	if prefix { str(prefix, " ", code) } else { code }
+}
+
+kIntegralTypes := set{"long", "int", "short", "byte"}
+kFloatingTypes := set{"double", "float"}
+
 // Returns a map of parser targets to functions that generate the
 // corresponding Clojure code.
 func codeGenerator(symbolTable, isGoscript) {
@@ -90,8 +112,8 @@ func codeGenerator(symbolTable, isGoscript) {
 
 	// Capitalized
 	func isPublic(identifier) {
-		// not lowercode
-		!(/^\p{Ll}/  reFind  identifier) || identifier == "main" ||(/^bit-/  reFind  identifier)
+		// not lowercode, ignoring the earmuffs of a dynamic var
+		!(/^\*?\p{Ll}/  reFind  identifier) || identifier == "main" ||(/^bit-/  reFind  identifier)
 	}
 
 	// Return a function that always returns the given constant string.
@@ -121,6 +143,251 @@ func codeGenerator(symbolTable, isGoscript) {
 		}
 	}
 
+	// Return the [lhs, rhs] pairs of a binding whose arguments are
+	// the left-hand sides, then the operator, then the right-hand sides.
+	func bindingPairs(construct, operator, args) {
+		vArgs List := vec(args)
+		opPos      := vArgs->indexOf(operator)
+		n          := vArgs->size()
+		if  n % 2 != 1 || (n - 1) / 2 != opPos {
+			throw(new IOException(
+				str("LHS and RHS of ", construct, " do not match")  str  blankJoin(vArgs)
+			))
+		} else {
+			for i := lazy \`range`(opPos) {
+				[vArgs[i], vArgs[opPos + 1 + i]]
+			}
+		}
+	}
+
+	func bindingsStr(pairs) {
+		" "  s.join  (for [lhs, rhs] := lazy pairs { str(lhs, " ", rhs) })
+	}
+
+	// The names declared by the code generated for a struct field.
+	func fieldNames(field String) {
+		func(token String){ !token->startsWith("^") }  filter  (field  s.split  / /)
+	}
+
+	// Add the given metadata to each name declared by a struct field.
+	func withFieldMeta(meta, field String) {
+		blankJoin(...(for token := lazy field  s.split  / / {
+			if token->startsWith("^") { token } else { str(meta, " ", token) }
+		}))
+	}
+
+	// Whether a field of a value struct equals that of the other one,
+	// comparing primitive fields without boxing them.
+	func fieldEquals(name, typ, other) {
+		that := listStr(".-"  str  name, other)
+		switch {
+		case (kIntegralTypes  isContains  typ) || isGoscript && (kFloatingTypes  isContains  typ):
+			listStr("==", name, that)
+		case kFloatingTypes  isContains  typ:
+			listStr("zero?", listStr("Double/compare", name, that))
+		default:
+			listStr("=", name, that)
+		}
+	}
+
+	// The hash of a field of a value struct, without boxing it if it
+	// is primitive.
+	func fieldHash(name, typ) {
+		switch {
+		case isGoscript:                          listStr("hash", name)
+		case kIntegralTypes  isContains  typ:     listStr("Long/hashCode", name)
+		case kFloatingTypes  isContains  typ:     listStr("Double/hashCode", name)
+		case typ == "boolean":                    listStr("Boolean/hashCode", name)
+		case typ == "char":                       listStr("Character/hashCode", name)
+		default:                                  listStr("hash", name)
+		}
+	}
+
+	// The equality, hash and string methods of a value struct, given
+	// the [name type] pairs of its immutable fields and the names of
+	// all of them.  Mutable fields are private to the type, so only the
+	// immutable ones take part in equality.
+	func valueMethods(typ, immutable, all) {
+		other    := "^"  str  typ  str  " other"
+		isEqual  := listStr("and", listStr("instance?", typ, "other"), ...(for [f, t] := lazy immutable {
+			fieldEquals(f, t, other)
+		}))
+		combine  := if isGoscript { "hash-combine" } else { "clojure.lang.Util/hashCombine" }
+		hashes   := for [f, t] := lazy immutable { fieldHash(f, t) }
+		hash     := if isEmpty(hashes) { nil } else { reduce(func(h, f) { listStr(combine, h, f) }, hashes) }
+		toString := listStr("toString", "[this]",
+			listStr("str", `"{"`, ` " " `  s.join  all, `"}"`))
+		switch {
+		case isEmpty(immutable):
+			blankJoin("Object", toString)
+		case isGoscript:
+			blankJoin(
+				"IEquiv", listStr("-equiv", "[this other]", isEqual),
+				"IHash", listStr("-hash", "[this]", hash),
+				"Object", toString
+			)
+		default:
+			blankJoin(
+				"Object",
+				listStr("equals", "[this other]", isEqual),
+				listStr("hashCode", "[this]", hash),
+				toString
+			)
+		}
+	}
+
+	// The protocol of the receiver methods with the name.  Protocol
+	// methods are vars of the namespace, so a method name shared by
+	// several types must have a single protocol.
+	func methodProtocol(name) {
+		name  str  "Method"
+	}
+
+	func keywordArgs(named) {
+		for arg := lazy named { str(":", NAME(arg), " ", EXPR(arg)) }
+	}
+
+	// A call with named arguments, checked against the signature of
+	// the function if it was declared in this package.  Positional
+	// defaults are arities of the function, but a call that names
+	// arguments passes :anglx/default for each positional one it leaves
+	// out, which needs the signature.
+	func namedCall(function, args) {
+		signature  := symbolTable  symbols.Signature  function
+		positional := POSITIONAL(args)
+		named      := NAMED(args)
+		if signature {
+			required := REQUIRED(signature)
+			if count(positional) < required {
+				throw(new IOException(str("too few arguments in call to ", function)))
+			}
+			if count(positional) > required + OPTIONAL(signature) {
+				throw(new IOException(str("too many positional arguments in call to ", function)))
+			}
+			for arg := range named {
+				if !(NAMES(signature)  isContains  NAME(arg)) {
+					throw(new IOException(str(function, " has no parameter named ", NAME(arg))))
+				}
+			}
+		}
+		for [name, n] := range frequencies(map(NAME, named)) {
+			if n > 1 {
+				throw(new IOException(str("parameter ", name, " given more than once in call to ", function)))
+			}
+		}
+		missing := if signature && !isEmpty(named) {
+			REQUIRED(signature) + OPTIONAL(signature) - count(positional)
+		} else {
+			0
+		}
+		listStr(function, ...concat(positional, repeat(missing, ":anglx/default"), keywordArgs(named)))
+	}
+
+	// A try that returns the error of a failed ? check in the body as
+	// the error of a [value, error] pair.  Other exceptions are not
+	// caught.
+	func errorScope(body) {
+		exception := if isGoscript { ":default" } else { "clojure.lang.ExceptionInfo" }
+		listStr("try", body, listStr("catch", exception, "anglx-e",
+			listStr("if", "(contains? (ex-data anglx-e) :anglx/error)",
+				"[nil (:anglx/error (ex-data anglx-e))]",
+				"(throw anglx-e)")))
+	}
+
+	// A loop over a local that is a primitive long if the loop is
+	// integral, which unlike dotimes or doseq over a range does not
+	// allocate.
+	func primitiveLoop(ident, init, isIntegral, condition, next, expressions) {
+		start := if isIntegral { listStr("long", init) } else { init }
+		listStr("loop", vecStr(ident, start),
+			listStr("when", condition, expressions, listStr("recur", next)))
+	}
+
+	// A loop from start to (inclusive) or until (exclusive) end.  The
+	// loop counts down if the step is negative, which is decided as it
+	// runs unless the step is a literal.  An end or step that is not a
+	// literal or a name is evaluated once, before the loop.
+	func numericLoop(ident, start, kind, end, step, expressions, shape) {
+		[up, down] := if kind == "to" { ["<=", ">="] } else { ["<", ">"] }
+		endName    := if IS_SIMPLE_END(shape) { end } else { "anglx-end" }
+		stepName   := if IS_SIMPLE_STEP(shape) { step } else { "anglx-step" }
+		comparison := switch DIRECTION(shape) {
+		case UP:   listStr(up, ident, endName)
+		case DOWN: listStr(down, ident, endName)
+		default:
+			listStr("if", listStr("neg?", stepName), listStr(down, ident, endName), listStr(up, ident, endName))
+		}
+		next       := if step { listStr("+", ident, stepName) } else { listStr("inc", ident) }
+		bindings   := concat(
+			if IS_SIMPLE_END(shape) { [] } else { ["anglx-end", end] },
+			if IS_SIMPLE_STEP(shape) { [] } else { ["anglx-step", step] }
+		)
+		loop       := primitiveLoop(ident, start, IS_INTEGRAL(shape), comparison, next, expressions)
+		if isEmpty(bindings) { loop } else { listStr("let", vecStr(...bindings), loop) }
+	}
+
+	// The n of an index written as the literal -n, or nil.
+	func negated(i) {
+		if isMap(i) { FROM_END(i) }
+	}
+
+	func fromEnd(xs, i) {
+		if n := negated(i); n { listStr("-", listStr("count", xs), n) } else { i }
+	}
+
+	// Apply f to the operand, first binding it to a local if it is not
+	// a simple name, so that it is evaluated only once.
+	func withOperand(xs String, f) {
+		if reMatches(/[\p{L}\p{Nd}_.\-?!*\/]+/, xs) {
+			f(xs)
+		} else {
+			listStr("let", vecStr("anglx-xs", xs), f("anglx-xs"))
+		}
+	}
+
+	func indexed(xs, i) {
+		if negated(i) {
+			withOperand(xs, func(v){ listStr("nth", v, fromEnd(v, i)) })
+		} else {
+			listStr("nth", xs, i)
+		}
+	}
+
+	// A slice from start to end, either of which may be nil for the
+	// start or end of the sequence.  A string or vector is sliced with
+	// subs or subvec; any other sequence lazily.
+	func slice(xs, start, end, kind) {
+		isCounted := negated(start) && end && !negated(end)
+		switch {
+		case kind:
+			withOperand(xs, func(v) {
+				subseq := if kind == STRING { "subs" } else { "subvec" }
+				switch {
+				case !end:   listStr(subseq, v, fromEnd(v, start))
+				case !start: listStr(subseq, v, "0", fromEnd(v, end))
+				default:     listStr(subseq, v, fromEnd(v, start), fromEnd(v, end))
+				}
+			})
+		case isCounted:
+			withOperand(xs, func(v) {
+				listStr("take", listStr("-", end, fromEnd(v, start)), listStr("take-last", negated(start), v))
+			})
+		default: {
+			from := switch {
+			case !start:          xs
+			case negated(start): listStr("take-last", negated(start), xs)
+			default:              listStr("drop", start, xs)
+			}
+			switch {
+			case !end:          from
+			case negated(end): listStr("drop-last", negated(end), from)
+			case start:         listStr("take", listStr("-", end, start), from)
+			default:            listStr("take", end, from)
+			}
+		}
+		}
+	}
+
 	func stripQuotes(literal string) string{
 		literal->substring(1, literal->length() - 1)
 	}
@@ -151,29 +418,28 @@ func codeGenerator(symbolTable, isGoscript) {
 	}
 
 	func vardecl(identifier, expression) {
+		vardecl(nil, identifier, nil, expression)
+	} (identifier, typ, expression) {
+		vardecl(nil, identifier, typ, expression)
+	} (metadata, identifier, typ, expression) {
+		private := if !isPublic(identifier) { "^:private" }
+		hint    := if typ { "^"  str  typ }
+		listStr("def", ...remove(isNil, [private, hint, metadata, identifier, expression]))
+	}
+
+	func def_(identifier, expression) {
 		if isPublic(identifier) {
 			listStr("def", identifier, expression)
 		} else {
 			listStr("def", "^:private", identifier, expression)
 		}
-	} (identifier, typ, expression) {
-		if isPublic(identifier) {
-			listStr("def", "^"  str  typ, identifier, expression)
-		} else {
-			listStr("def",
-				"^:private",
-				"^"  str  typ,
-				identifier,
-				expression
-			)
-		}
 	}
 
-	func def_(identifier, expression) {
+	func privatized(identifier) {
 		if isPublic(identifier) {
-			listStr("def", identifier, expression)
+			identifier
 		} else {
-			listStr("def", "^:private", identifier, expression)
+			"^:private "  str  identifier
 		}
 	}
 
@@ -212,6 +478,17 @@ func codeGenerator(symbolTable, isGoscript) {
 		TYPECLASSESIMPORTSPEC: blankJoin,
 		PRECEDENCE00: infix,
 		PRECEDENCE0: infix,
+		PIPE: func(initial, steps...) {
+			groups := partitionBy(first, partition(2, steps))
+			reduce(func(acc, group) {
+				listStr(first(first(group)), acc, ...(second  map  group))
+			}, initial, groups)
+		},
+		PIPEPLACEHOLDER: func{listStr(listStr("fn", "[anglx-it]", $1))},
+		THREADLAST:      constantFunc("->>"),
+		THREADFIRST:     constantFunc("->"),
+		SOMETHREADLAST:  constantFunc("some->>"),
+		SOMETHREADFIRST: constantFunc("some->"),
 		PRECEDENCE1: infix,
 		PRECEDENCE2: infix,
 		PRECEDENCE3: infix,
@@ -319,6 +596,25 @@ func codeGenerator(symbolTable, isGoscript) {
 			)
 		},
 		CONSTCASECLAUSE: blankJoin,
+		MATCHSTMT: func(expr, clauses...) {
+			listStr("match", vecStr(expr), ...clauses)
+		},
+		MATCHCLAUSE: func(pattern, expressions) {
+			blankJoin(vecStr(pattern), expressions)
+		} (pattern, guard, expressions) {
+			guardFn := listStr("fn", "[anglx-match]",
+				listStr("match", "[anglx-match]", vecStr(pattern), guard, ":else", "false"))
+			blankJoin(vecStr(listStr(pattern, ":guard", guardFn)), expressions)
+		},
+		MATCHDEFAULT: func(expressions) {
+			blankJoin(":else", expressions)
+		},
+		MATCHGUARD: identity,
+		VECPATTERN: vecStr,
+		DICTPATTERN: func{str("{", blankJoin(...$*), "}")},
+		DICTPATTERNELEM: func(pattern, key) {
+			str(key, " ", pattern)
+		},
 		CONSTANTLIST: func(c) {
 			c
 		}(c0, c...){
@@ -329,14 +625,18 @@ func codeGenerator(symbolTable, isGoscript) {
 		} (cond) {
 			cond
 		},
-		FORRANGE: func(identifier, seq, expressions) {
-			str("(doseq [", identifier, " ", seq, "] ", expressions, ")")
+		FORRANGE: func(args...) {
+			listStr("doseq", vecStr(...butlast(args)), last(args))
+		},
+		FORLAZY: func(args...) {
+			listStr("for", vecStr(...butlast(args)), last(args))
 		},
-		FORLAZY: func(identifier, seq, expressions) {
-			str("(for [", identifier, " ", seq, "] ", expressions, ")")
-		} (identifier, seq, condition, expressions) {
-			str("(for [", identifier, " ", seq, " :when ", condition, "] ", expressions, ")")
+		FORBINDING: blankJoin,
+		FORLET: func(destruct, expression) {
+			str(":let [", destruct, " ", expression, "]")
 		},
+		FORWHILE: func{":while "  str  $1},
+		FORWHEN: func{":when "  str  $1},
 		FORTIMES: func(identifier, count, expressions) {
 			str("(dotimes [", identifier, " ", count, "] ", expressions, ")")
 		},
@@ -348,6 +648,23 @@ func codeGenerator(symbolTable, isGoscript) {
 			}
 			str("(dotimes [", ident, " ", count, "] ", expressions, ")")
 		},
+		FORNUMERIC: func(ident, start, kind, end, expressions, shape) {
+			numericLoop(ident, start, kind, end, nil, expressions, shape)
+		} (ident, start, kind, end, step, expressions, shape) {
+			numericLoop(ident, start, kind, end, step, expressions, shape)
+		},
+		FORLOOP: func(ident, init, condition, step, expressions, shape) {
+			if ident != NAME(step) {
+				throw(new IOException(
+					`cannot mix different identifiers in c-style for loop`
+				))
+			}
+			primitiveLoop(ident, init, IS_INTEGRAL(shape), condition, NEXT(step), expressions)
+		},
+		INCREMENT: func(ident) { {NAME: ident, NEXT: listStr("inc", ident)} },
+		DECREMENT: func(ident) { {NAME: ident, NEXT: listStr("dec", ident)} },
+		STEPADD:   func(ident, expr) { {NAME: ident, NEXT: listStr("+", ident, expr)} },
+		STEPSUB:   func(ident, expr) { {NAME: ident, NEXT: listStr("-", ident, expr)} },
 		TRYEXPR: func(expressions, catches) {
 			listStr("try", expressions, catches)
 		} (expressions, catches, finally) {
@@ -358,6 +675,18 @@ func codeGenerator(symbolTable, isGoscript) {
 			listStr("catch", typ, exception, expressions)
 		},
 		FINALLY: func{listStr("finally", $1)},
+		ATTEMPT: func(expressions) {
+			[exception, message] := if isGoscript {
+				[":default", "(.-message anglx-e)"]
+			} else {
+				["Exception", "(.getMessage anglx-e)"]
+			}
+			listStr("try", vecStr(expressions, "nil"),
+				listStr("catch", exception, "anglx-e",
+					vecStr("nil", listStr("if", "(contains? (ex-data anglx-e) :anglx/error)",
+						"(:anglx/error (ex-data anglx-e))",
+						listStr("ex-info", message, "{:cause anglx-e}")))))
+		},
 		NEW:	 func{str($1, ".")},
 		SHORTVARDECL:	func(identifier, expression) {
 			def_(identifier, expression)
@@ -378,18 +707,39 @@ func codeGenerator(symbolTable, isGoscript) {
 			elements := blankJoin(...(for _ := times readString(number) {"nil"}))
 			listStr("def", identifier, listStr("vector", elements))
 		},
-		VARDECL1: vardecl,
-		VARDECL2: func(identifier1, identifier2, expression1, expression2) {
-			blankJoin(
-				vardecl(identifier1, expression1),
-				vardecl(identifier2, expression2)
-			)
-		} (identifier1, identifier2, typ, expression1, expression2) {
+		VARDECL1: withDecorations(func(decorations, identifier, args...) {
+			typ := if count(args) == 2 { first(args) }
+			vardecl(META(decorations), identifier, typ, prefixed(DOC(decorations), last(args)))
+		}),
+		STATEVARDECL: withDecorations(func(decorations, identifier, kind, expression) {
+			vardecl(META(decorations), identifier, nil, prefixed(DOC(decorations), listStr(kind, expression)))
+		}),
+		DYNAMICVARDECL: withDecorations(func(decorations, identifier, args...) {
+			typ      := if count(args) == 2 { first(args) }
+			metadata := " "  s.join  remove(isNil, ["^:dynamic", META(decorations)])
+			vardecl(metadata, identifier, typ, prefixed(DOC(decorations), last(args)))
+		}),
+		STATEUPDATE: func(kind, state, function) {
+			listStr(kStateUpdates(kind), state, function)
+		},
+		STATEUPDATECALL: func(kind, state, function, args) {
+			listStr(kStateUpdates(kind), state, function, ...concat(POSITIONAL(args), keywordArgs(NAMED(args))))
+		},
+		STATEASSIGN: func(kind, identifier, expression) {
+			switch kind {
+			case "atom": listStr("reset!", identifier, expression)
+			case "ref":  listStr("ref-set", identifier, expression)
+			default:     listStr("send", identifier, listStr("constantly", expression))
+			}
+		},
+		VARDECL2: withDecorations(func(decorations, identifier1, identifier2, args...) {
+			[typ, expression1, expression2] := if count(args) == 3 { args } else { nil  cons  args }
+			[metadata, doc] := [META(decorations), DOC(decorations)]
 			blankJoin(
-				vardecl(identifier1, typ, expression1),
-				vardecl(identifier2, typ, expression2)
+				vardecl(metadata, identifier1, typ, prefixed(doc, expression1)),
+				vardecl(metadata, identifier2, typ, prefixed(doc, expression2))
 			)
-		},
+		}),
 		PREFIXEDROUTINE: listStr,
 		PREFIXEDBLOCK: listStr,
 		PREFIX: identity,
@@ -397,7 +747,17 @@ func codeGenerator(symbolTable, isGoscript) {
 		VARIADICCALL: func(function, params...) {
 			listStr("apply", function, ...params)
 		},
-		FUNCTIONCALL:	 listStr,
+		FUNCTIONCALL:	 func(function) {
+			listStr(function)
+		} (function, args) {
+			if isMap(args) { namedCall(function, args) } else { listStr(function, args) }
+		},
+		NAMEDARGS: func(args...) {
+			{POSITIONAL: remove(isMap, args), NAMED: filter(isMap, args)}
+		},
+		NAMEDARG: func(identifier, expression) {
+			{NAME: identifier, EXPR: expression}
+		},
 		LEN: func(call) {
 			listStr("count", call)
 		},
@@ -417,9 +777,27 @@ func codeGenerator(symbolTable, isGoscript) {
 			str("(do ",  " "  s.join  (expr0  cons  exprRest),	")")
 		},
 		TYPECONVERSION: listStr,
-		INDEXED: func(xs, i){ listStr("nth", xs, i) },
-		TAKESLICE: func(xs, i){ listStr("take", i, xs) },
-		DROPSLICE: func(xs, i){ listStr("drop", i, xs) },
+		FROMEND: func(n) { {FROM_END: n} },
+		INDEXED: func(xs, i) {
+			indexed(xs, i)
+		} (xs, i, kind) {
+			indexed(xs, i)
+		},
+		TAKESLICE: func(xs, i) {
+			slice(xs, nil, i, nil)
+		} (xs, i, kind) {
+			slice(xs, nil, i, kind)
+		},
+		DROPSLICE: func(xs, i) {
+			slice(xs, i, nil, nil)
+		} (xs, i, kind) {
+			slice(xs, i, nil, kind)
+		},
+		SLICE: func(xs, start, end) {
+			slice(xs, start, end, nil)
+		} (xs, start, end, kind) {
+			slice(xs, start, end, kind)
+		},
 		TOPWITHCONST: declBlockFunc("let"),
 		TOPWITHASSIGN: declBlockFunc("let"),
 		WITHCONST: declBlockFunc("let"),
@@ -430,33 +808,73 @@ func codeGenerator(symbolTable, isGoscript) {
 		},
 		ASSIGN: blankJoin,
 		SINGLEASSIGN: func(args...) {
-			vArgs List := vec(args)
-			opPos      := vArgs->indexOf("is")
-			n          := vArgs->size()
-			if  n % 2 != 1 || (n - 1) / 2 != opPos {
-				throw(new IOException(
-					"LHS and RHS of Given do not match"  str  blankJoin(vArgs)
-				))
-			} else {
-				" "  s.join  (for i := lazy \`range`(opPos) {
-					str(vArgs[i], " ", vArgs[opPos + 1 + i])
-				})
-			}
+			bindingsStr(bindingPairs("Given", "is", args))
 		},
 		MULTIPLEASSIGN: func(args...) {
-			vArgs List := vec(args)
-			opPos      := vArgs->indexOf("are")
-			n          := vArgs->size()
-			if  n % 2 != 1 || (n - 1) / 2 != opPos {
-				throw(new IOException(
-					"LHS and RHS of Given do not match"  str  blankJoin(vArgs)
-				))
+			[lhs, rhs] := splitWith(func{$1 != "are"}, args)
+			if count(rhs) == 2 {
+				// destructure a vector result, such as a value and an error
+				str(vecStr(...lhs), " ", last(rhs))
 			} else {
-				" "  s.join  (for i := lazy \`range`(opPos) {
-					str(vArgs[i], " ", vArgs[opPos + 1 + i])
-				})
+				bindingsStr(bindingPairs("Given", "are", args))
 			}
 		},
+		CHECKED: func(expression) {
+			listStr("let", str("[[anglx-value anglx-error] ", expression, "]"),
+				listStr("if", "anglx-error",
+					listStr("throw", `(ex-info "error" {:anglx/error anglx-error})`),
+					"anglx-value"))
+		},
+		ERRORSCOPE: func(body) {
+			errorScope(body)
+		} (body, arity) {
+			// recur cannot cross a try, so it is done after it
+			args := for i := lazy \`range`(arity) { str("anglx-arg", i) }
+			listStr("let", vecStr("anglx-result", errorScope(body)),
+				listStr("if", "(and (map? anglx-result) (contains? anglx-result :anglx/recur))",
+					listStr("let", vecStr(vecStr(...args), "(:anglx/recur anglx-result)"), listStr("recur", ...args)),
+					"anglx-result"))
+		},
+		ERRORSCOPERECUR: func(args...) {
+			str("{:anglx/recur ", vecStr(...args), "}")
+		},
+		DEFERRED: func(deferred, body...) {
+			listStr("try", ...(body  concat  [listStr("finally", deferred)]))
+		},
+		DEFERSTMT: func(expr) {
+			throw(new IOException(
+				"defer must be a statement in a function body or block: defer "  str  expr
+			))
+		},
+		WITHSINGLE: func(args...) {
+			bindingPairs("with", "is", args)
+		},
+		WITHMULTIPLE: func(args...) {
+			bindingPairs("with", "are", args)
+		},
+		REBINDING: blankJoin,
+		REBIND: func(args...) {
+			listStr("binding", vecStr(...butlast(args)), last(args))
+		},
+		WITHOPEN: func(pairs, expressions, resources) {
+			// with-open only binds symbols, so a destructured
+			// resource is bound by a let, inside which each of
+			// the names it binds is closed
+			groups := partitionBy(func{isEmpty(second($1))}, map(vector, pairs, resources))
+			reduce(func(body, group) {
+				[[_, names]] := group
+				if isEmpty(names) {
+					listStr("with-open", vecStr(bindingsStr(first  map  group)), body)
+				} else {
+					reduce(func(inner, [[lhs, rhs], names]) {
+						listStr("let", vecStr(lhs, rhs),
+							listStr("with-open", vecStr(bindingsStr(map(vector, names, names))), inner))
+					}, body, reverse(group))
+				}
+			}, expressions, reverse(groups))
+		},
+		DESTRUCTUREDRESOURCES: vector,
+		RESOURCES:             vector,
 		VECDESTRUCT: vecStr,
 		DICTDESTRUCT: func{str('{', (" "  s.join  $*), "}")},
 		DICTDESTRUCTELEM: func(destruct, label) {
@@ -478,14 +896,112 @@ func codeGenerator(symbolTable, isGoscript) {
 		ADDOP: identity,
 		RELOP: identity,
 		OPERATOR: identity,
-		FUNCTIONDECL:	func(identifier, function) {
+		FUNCTIONDECL:	withDecorations(func(decorations, identifier, function) {
 			defn := if isPublic(identifier) { "defn" } else { "defn-" }
-			listStr(defn, identifier, function)
+			listStr(defn, prefixed(META(decorations), identifier), prefixed(DOC(decorations), function))
+		}),
+		MACRODECL:	withDecorations(func(decorations, identifier, function) {
+			if isGoscript {
+				throw(new IOException(str(
+					"macro ", identifier, " must be defined in a .anx file",
+					" and imported with import macros"
+				)))
+			}
+			listStr("defmacro", prefixed(META(decorations), privatized(identifier)), prefixed(DOC(decorations), function))
+		}),
+		DOCSTRING:	func(text) {
+			{DOC: prStr(text)}
+		},
+		ANNOTATION:	func(name) {
+			"^:"  str  name
+		} (name, expression) {
+			str("^{:", name, " ", expression, "}")
+		},
+		ANNOTATIONS:	func(annotations...) {
+			{META: blankJoin(...annotations)}
+		},
+		RECEIVERDECL:	func(args...) {
+			throw(new IOException("receiver methods must be declared at top level"))
+		},
+		RECEIVER:	func(identifier, typ) {
+			[identifier, typ]
+		},
+		RECEIVERPARAMS:	func(params...) {
+			{NAMES: params, IS_VARIADIC: some(func(p String){ p->startsWith("& ") }, params)}
+		},
+		RECEIVERMETHOD:	func(receiver, name, params, body) {
+			{RECEIVER: first(receiver), NAME: name, PARAMS: params, BODY: body}
+		} (receiver, name, params, returnType, body) {
+			{RECEIVER: first(receiver), NAME: name, PARAMS: params, RETURN_TYPE: returnType, BODY: body}
+		},
+		RECEIVERPROTOCOLS: func(methods...) {
+			if variadic := first(func{IS_VARIADIC(PARAMS($1))}  filter  methods); variadic {
+				throw(new IOException(str("receiver method ", NAME(variadic), " cannot be variadic")))
+			}
+			byName := NAME  groupBy  methods
+			blankJoin(...(for name := lazy distinct(NAME  map  methods) {
+				arity    := func{count(NAMES(PARAMS($1)))}
+				protocol := methodProtocol(name)
+				symbolTable  symbols.TypeCreated  protocol
+				listStr("defprotocol", protocol, listStr(name, ...(for n := lazy distinct(arity  map  byName(name)) {
+					m := first(filter(func{arity($1) == n}, byName(name)))
+					vecStr("this", ...NAMES(PARAMS(m)))
+				})))
+			}))
+		},
+		RECEIVERMETHODS: func(typ, methods...) {
+			byName := NAME  groupBy  methods
+			listStr("extend-type", typ, ...(for name := lazy distinct(NAME  map  methods) {
+				arities := for m := lazy byName(name) {
+					str(
+						if RETURN_TYPE(m) { str("^", RETURN_TYPE(m), " ") } else { "" },
+						vecStr(RECEIVER(m), ...NAMES(PARAMS(m))),
+						" ",
+						BODY(m)
+					)
+				}
+				blankJoin(
+					methodProtocol(name),
+					if count(arities) == 1 {
+						listStr(name, first(arities))
+					} else {
+						listStr(name, ...(listStr  map  arities))
+					}
+				)
+			}))
+		},
+		MULTIDECL:	func(identifier, parameters, dispatch) {
+			symbols.MultiCreated(symbolTable, identifier)
+			listStr("defmulti", privatized(identifier), listStr("fn", vecStr(parameters), dispatch))
+		} (identifier, parameters, dispatch, hierarchy) {
+			symbols.MultiCreated(symbolTable, identifier)
+			listStr("defmulti", privatized(identifier), listStr("fn", vecStr(parameters), dispatch),
+				":hierarchy", listStr("var", hierarchy))
+		},
+		METHODDECL:	func(multiName, dispatchValue, function) {
+			if !(/\//  reFind  multiName) && !symbols.HasMulti(symbolTable, multiName) {
+				throw(new IOException(str("method ", multiName, " has no multi func declaration")))
+			}
+			listStr("defmethod", multiName, dispatchValue, function)
+		},
+		METHODDEFAULT:	constantFunc(":default"),
+		DERIVEDECL:	func(child, parent) {
+			// labels are not namespace-qualified, which the global
+			// hierarchy requires, and dispatch values would not match
+			// them if they were
+			if some(func{reMatches(/:[^\/]+/, $1)}, [child, parent]) {
+				throw(new IOException(str("derive ", child, " from ", parent,
+					" needs a hierarchy, as in derive ... in hierarchyVar")))
+			}
+			listStr("derive", child, parent)
+		} (child, parent, hierarchy) {
+			listStr("alter-var-root", listStr("var", hierarchy), "derive", child, parent)
 		},
 		FUNCLIKEDECL:	func(funclike, identifier, function) {
 			listStr(funclike, identifier, function)
 		},
 		FUNCTIONLIT:	func{listStr("fn", $1)},
+		NAMEDFUNCTIONLIT: func(name, function) { listStr("fn", name, function) },
 		SHORTFUNCTIONLIT:  func(expr) {
 			if first(expr) == '(' && last(expr) == ')' {
 				"#"  str  expr
@@ -493,9 +1009,9 @@ func codeGenerator(symbolTable, isGoscript) {
 				listStr("fn", "[]", expr)
 		}
 		},
-		STRUCTSPEC: func(javaIdentifier, fields...) {
+		STRUCTSPEC: withDecorations(func(decorations, javaIdentifier, fields...) {
 			symbolTable  symbols.TypeCreated  javaIdentifier
-			listStr("defrecord",
+			record := listStr("defrecord",
 				javaIdentifier,
 				vecStr(...fields),
 				if isEmpty(fields) {
@@ -510,8 +1026,59 @@ func codeGenerator(symbolTable, isGoscript) {
 					)
 				}
 			)
-		},
+			// Records cannot have docstrings, so document the constructor
+			if DOC(decorations) && !isGoscript {
+				blankJoin(record, listStr(
+					"alter-meta!", listStr("var", "->"  str  javaIdentifier), "assoc", ":doc", DOC(decorations)
+				))
+			} else {
+				record
+			}
+		}),
 		FIELDS: blankJoin,
+		VALUESTRUCTSPEC: func(javaIdentifier, parts...) {
+			symbolTable  symbols.TypeCreated  javaIdentifier
+			[fields, impls] := if isMap(first(parts)) {
+				[first(parts), rest(parts)]
+			} else {
+				[{DECLS: [], IMMUTABLE: [], ALL: []}, parts]
+			}
+			listStr(
+				"deftype",
+				javaIdentifier,
+				vecStr(...DECLS(fields)),
+				valueMethods(javaIdentifier, IMMUTABLE(fields), ALL(fields)),
+				...impls
+			)
+		},
+		VALUEFIELDS: func(args...) {
+			fields := butlast(args)
+			{
+				DECLS:     for f := lazy fields { if isString(f) { f } else { DECL(f) } },
+				IMMUTABLE: FIELD_TYPES(last(args)),
+				ALL:       mapcat(func{ fieldNames(if isString($1) { $1 } else { NAMES($1) }) }, fields)
+			}
+		},
+		FIELDTYPES: func(pairs...) {
+			{FIELD_TYPES: pairs}
+		},
+		FIELDTYPE: func(name) {
+			[name, nil]
+		} (name, typ) {
+			[name, typ]
+		},
+		MUTABLEFIELD: func(field) {
+			{DECL: "^:unsynchronized-mutable"  withFieldMeta  field, NAMES: field}
+		},
+		VOLATILEFIELD: func(field) {
+			{DECL: "^:volatile-mutable"  withFieldMeta  field, NAMES: field}
+		},
+		VALUEIMPL: func(protocol, methodimpls...) {
+			blankJoin(protocol, ...methodimpls)
+		},
+		SETFIELD: func(identifier, expression) {
+			listStr("set!", identifier, expression)
+		},
 		INTERFACESPEC: func(args...){
 			symbolTable  symbols.TypeCreated  first(args)
 			listStr("defprotocol", ...args)
@@ -563,6 +1130,10 @@ func codeGenerator(symbolTable, isGoscript) {
 		} (parameters, variadic, typ, expression) {
 			str("^", typ, " [", parameters, " ", variadic, "] ", expression)
 		},
+		CONDITIONEDBODY: prefixed,
+		CONDITIONS:    func(conditions...) { str("{", blankJoin(...conditions), "}") },
+		PRECONDITION:  func(exprs...) { ":pre "  str  vecStr(...exprs) },
+		POSTCONDITION: func(exprs...) { ":post "  str  vecStr(...exprs) },
 		UNTYPEDMETHODIMPL: func(name, block) {
 			listStr(name, str("[this]"), block)
 		} (name, params, block) {
@@ -573,6 +1144,40 @@ func codeGenerator(symbolTable, isGoscript) {
 		} (name, params, typ, block) {
 			listStr("^"  str  typ, name, str("[this ", params, "]"), block)
 		},
+		KWFUNCTIONPART: func(args...) {
+			[parameters, defaults, more] := if isString(first(args)) {
+				[[first(args)], second(args), drop(2, args)]
+			} else {
+				[[], first(args), rest(args)]
+			}
+			[typ, expression] := if count(more) == 2 { more } else { [nil, first(more)] }
+			if some(IS_POSITIONAL, defaults) {
+				throw(new IOException(
+					"positional default parameters are only allowed in func declarations and function literals"))
+			}
+			names := for d := lazy defaults { NAME(d) }
+			keys  := str("{:keys ", vecStr(...names), " :or {",
+				blankJoin(...(for d := lazy defaults { str(NAME(d), " ", DEFAULT(d)) })), "}}")
+			str(
+				if typ { str("^", typ, " ") } else { "" },
+				vecStr(...concat(parameters, ["&", keys])),
+				" ",
+				expression
+			)
+		},
+		DEFAULTPARAMS: vector,
+		DEFAULTEDBODY: func(defaults, body) {
+			bindings := for d := lazy defaults {
+				str(NAME(d), " ", listStr("if", listStr("=", NAME(d), ":anglx/default"), DEFAULT(d), NAME(d)))
+			}
+			listStr("let", vecStr(...bindings), body)
+		},
+		POSITIONALDEFAULT: func(identifier, expression) {
+			{NAME: identifier, DEFAULT: expression, IS_POSITIONAL: true}
+		},
+		NAMEDDEFAULT: func(identifier, expression) {
+			{NAME: identifier, DEFAULT: expression}
+		},
 		PARAMETERS:	blankJoin,
 		VARIADIC:	func{"& "  str  $1},
 		VECLIT:		vecStr,
@@ -585,6 +1190,8 @@ func codeGenerator(symbolTable, isGoscript) {
 		LABEL:		func{":"  str  s.replace(s.lowerCase($1), /_/, "-")},
 		ISLABEL:	func{str(":", s.replace(s.lowerCase($1), /_/, "-"), "?")},
 		IDENTIFIER:	camelcaseToDashed,
+		// dynamic vars get earmuffs, e.g. logLevel to *log-level*
+		DYNAMICIDENTIFIER: func{str("*", camelcaseToDashed($1), "*")},
 		TYPEDIDENTIFIER: func(identifier, typ) {
 			str(`^`, typ, " ", identifier)
 		},
@@ -614,6 +1221,9 @@ func codeGenerator(symbolTable, isGoscript) {
 		INTERPRETEDSTRINGLIT: func(literal) {
 			str(`"`, stripQuotes(literal), `"`)
 		},
+		INTERPOLATEDSTRING: func(parts...) {
+			listStr("str", ...parts)
+		},
 		RAWSTRINGLIT: func{str(`"`, s.escape($1, charEscapeString), `"`)},
 		CLOJUREESCAPE: identity,
 		LITTLEUVALUE:  func(d1,d2,d3,d4){str(`\u`,d1,d2,d3,d4)},
@@ -639,6 +1249,7 @@ func codeGenerator(symbolTable, isGoscript) {
 			str( s.lowerCase(initial), identifier, "!")
 		},
 		ESCAPEDIDENTIFIER:  func{ stripQuotes($1) },
+		GENSYMIDENTIFIER:   func{ $1  str  "#" },
 		UNARYEXPR: func(e) {
 			e
 		} (operator, expression){
@@ -705,6 +1316,22 @@ func syncImports(isGoscript, isSync) {
 	}
 }
 
+func matchImports(isGoscript, isMatch) {
+	switch {
+	case !isMatch:   []
+	case isGoscript: [vecStr("cljs.core.match", ":refer-macros", "[match]")]
+	default:        [vecStr("clojure.core.match", ":refer", "[match]")]
+	}
+}
+
+func specImports(isGoscript, specMode) {
+	lib := if isGoscript { "cljs.spec" } else { "clojure.spec" }
+	concat(
+		if specMode { [vecStr(lib  str  ".alpha", ":as", "anglx-spec")] } else { [] },
+		if specMode == VALIDATE { [vecStr(lib  str  ".test.alpha", ":as", "anglx-spec-test")] } else { [] }
+	)
+}
+
 func macroSyncImports(isGoscript, isSync) {
 	if isSync || !isGoscript {
 		[]
@@ -722,19 +1349,23 @@ func req(head, tail) {
 	}
 }
 
-func packageclauseFunc(symbolTable, path String, isGoscript, isSync) {
+func packageclauseFunc(symbolTable, path String, isGoscript, isSync, isMatch, specMode) {
 	[parent, name] := splitPath(path)
 	if isGoscript {
 		symbolTable  symbols.PackageCreated  "js"
 	}
-	func(imported, importDecls String) {
+	withDecorations(func(decorations, imported, importDecls String) {
 		fullImported     := parent  str  imported
 		hasImports       := importDecls->contains(":require ")
 		hasMacroImports  := importDecls->contains(":require-macros ")
 		xtraImports      := if hasImports {
 			[]
 		} else {
-			req(":require", syncImports(isGoscript, isSync))
+			req(":require", concat(
+				syncImports(isGoscript, isSync),
+				matchImports(isGoscript, isMatch),
+				specImports(isGoscript, specMode)
+			))
 		}
 		xtraMacroImports := if hasMacroImports {
 			[]
@@ -748,66 +1379,1236 @@ func packageclauseFunc(symbolTable, path String, isGoscript, isSync) {
 				name, `" in "`, path, `"`
 			)))
 		}
+		doc              := DOC(decorations)
+		nsName           := if doc { str(fullImported, " ", doc) } else { fullImported }
 		if isGoscript {
-			listStr("ns", fullImported, ...imports)
+			listStr("ns", nsName, ...imports)
 		} else {
 			str(
-				listStr("ns", fullImported, "(:gen-class)", ...imports),
+				listStr("ns", nsName, "(:gen-class)", ...imports),
 				" (set! *warn-on-reflection* true)"
 			)
 		}
-	}
+	})
 }
 
-func importDeclFunc(isGoscript, isSync) {
+func importDeclFunc(isGoscript, isSync, isMatch, specMode) {
 	func() {
 		""
 	} (importSpecs...) {
-		imports := importSpecs  concat  syncImports(isGoscript, isSync)
+		imports := concat(
+			importSpecs,
+			syncImports(isGoscript, isSync),
+			matchImports(isGoscript, isMatch),
+			specImports(isGoscript, specMode)
+		)
 		listStr(":require", ...imports)
 	}
 }
 
-func macroImportDeclFunc(isGoscript, isSync) {
-	func() {
-		""
-	} (importSpecs...) {
-		imports := importSpecs  concat  macroSyncImports(isGoscript, isSync)
-		listStr(":require-macros", ...imports)
+// On the JVM macros live in ordinary namespaces, so importing them is
+// the same as any other import, except that the implicit requires are
+// left to the ordinary imports if there are any.
+func macroImportDeclFunc(isGoscript, isSync, isMatch, specMode, hasImports) {
+	switch {
+	case !isGoscript && hasImports:
+		func() {
+			""
+		} (importSpecs...) {
+			listStr(":require", ...importSpecs)
+		}
+	case !isGoscript:
+		importDeclFunc(isGoscript, isSync, isMatch, specMode)
+	default:
+		func() {
+			""
+		} (importSpecs...) {
+			imports := importSpecs  concat  macroSyncImports(isGoscript, isSync)
+			listStr(":require-macros", ...imports)
+		}
 	}
 }
 
-func usesAsync(parsed) {
+// Return true if the parse tree has a node for any of the rules.
+func usesRules(rules, parsed) {
 	func walk(vector) {
 		if isEmpty(vector) {
 			false
 		} else {
 			f := first(vector)
-			if isVector(f) && usesAsync(f) {
+			if isVector(f) && usesRules(rules, f) {
 				true
 			} else {
 				recur(rest(vector))
 			}
 		}
 	}
-	if kAsyncRules  isContains  first(parsed) {
+	if rules  isContains  first(parsed) {
 		true
 	} else {
 		walk(rest(parsed))
 	}
 }
 
+// Return the position of the brace that closes an embedded expression
+// starting at the given position.
+func closingBrace(content String, from) {
+	loop(i = from, depth = 0) {
+		switch {
+		case i >= count(content):
+			throw(new IOException(str(`unterminated ${ in string literal "`, content, `"`)))
+		case content->charAt(i) == '{':
+			recur(i + 1, depth + 1)
+		case content->charAt(i) == '}':
+			if depth == 0 { i } else { recur(i + 1, depth - 1) }
+		default:
+			recur(i + 1, depth)
+		}
+	}
+}
+
+// Split the contents of an interpreted string literal into the literal
+// text and the [EXPR, source] of each embedded ${...} expression.  An
+// escaped \${ is literal text.
+func interpolationParts(content String) {
+	withText := func(parts, text) { if text == "" { parts } else { parts  conj  text } }
+	loop(parts = [], text = "", i = 0) {
+		switch {
+		case i >= count(content):
+			withText(parts, text)
+		case content->startsWith(`\${`, i):
+			recur(parts, text  str  "${", i + 3)
+		case content->charAt(i) == '\\':
+			recur(parts, text  str  subs(content, i, i + 2), i + 2)
+		case content->startsWith("${", i): {
+			end := closingBrace(content, i + 2)
+			recur(withText(parts, text)  conj  [EXPR, subs(content, i + 2, end)], "", end + 1)
+		}
+		default:
+			recur(parts, text  str  content->charAt(i), i + 1)
+		}
+	}
+}
+
+// Parse the source of an expression embedded in a string literal.
+func embeddedExpression(source String) {
+	parsed := parser.Parse(source, START, EXPRESSIONS)
+	if insta.isFailure(parsed) || count(parsed) != 2 {
+		throw(new IOException(str("cannot parse ${", source, "} in string literal as an expression")))
+	}
+	second(parsed)
+}
+
+// Replace each interpreted string literal containing ${...} by an
+// interpolatedstring node whose children are the literal text and the
+// parse trees of the embedded expressions.
+func interpolateStrings(node) {
+	switch {
+	case !isVector(node):
+		node
+	case first(node) == INTERPRETEDSTRINGLIT && second(node)->contains("${"): {
+		literal := second(node)
+		content := subs(literal, 1, count(literal) - 1)
+		parts   := for part := lazy interpolationParts(content) {
+			if isString(part) {
+				[INTERPRETEDSTRINGLIT, str(`"`, part, `"`)]
+			} else {
+				interpolateStrings(embeddedExpression(second(part)))
+			}
+		}
+		if count(parts) == 1 && first(first(parts)) == INTERPRETEDSTRINGLIT {
+			first(parts)
+		} else {
+			vec(INTERPOLATEDSTRING  cons  parts)
+		}
+	}
+	default:
+		vec(for child := lazy node { interpolateStrings(child) })
+	}
+}
+
+// Rules whose nodes get a docstring from the comment before them.
+kDocumentedRules := set{
+	PACKAGECLAUSE, FUNCTIONDECL, MACRODECL, VARDECL1, STATEVARDECL, DYNAMICVARDECL, STRUCTSPEC,
+	ANNOTATED
+}
+
+// Return the text of the block of // comment lines immediately
+// preceding the node in the source, or nil if there is none.  The
+// var or type keyword of a declaration may come between them.
+func docComment(source String, node) {
+	if span := insta.span(node); span {
+		start   := first(span)
+		leading := reFind(/^(?:\s|\/\/[^\n]*\n|\/\*[\s\S]*?\*\/)*/, subs(source, start))
+		before  := s.replace(subs(source, 0, start)  str  leading, /\b(?:var|type)\s*$/, "")
+		lines   := s.split(before, /\n/, -1)
+		isComment := func(line String) { line->trim()->startsWith("//") }
+		comments  := reverse(isComment  takeWhile  reverse(butlast(lines)))
+		if s.isBlank(last(lines)) && !isEmpty(comments) {
+			"\n"  s.join  (for c := lazy comments { s.replace(c->trim(), /^\/\/ ?/, "") })
+		}
+	}
+}
+
+// Add a docstring node at the end of each documented node that has a
+// doc comment.  This must be done before any other rewriting, while
+// the nodes still know where they are in the source.
+func attachDocs(source String, node) {
+	if !isVector(node) {
+		node
+	} else {
+		children := vec(for child := lazy node { attachDocs(source, child) })
+		doc      := (kDocumentedRules  isContains  first(node)) && docComment(source, node)
+		if doc {
+			children  conj  [DOCSTRING, doc]
+		} else {
+			children
+		}
+	}
+}
+
+// Move the annotations, and any docstring, of each annotated
+// declaration onto the end of the declaration itself.
+func attachAnnotations(node) {
+	switch {
+	case !isVector(node):
+		node
+	case first(node) == ANNOTATED: {
+		children        := for child := lazy rest(node) { attachAnnotations(child) }
+		isAnnotation    := func{first($1) == ANNOTATION}
+		[decl, docs...] := isAnnotation  remove  children
+		vec(concat(decl, [vec(ANNOTATIONS  cons  filter(isAnnotation, children))], docs))
+	}
+	default:
+		vec(for child := lazy node { attachAnnotations(child) })
+	}
+}
+
+kOperandWrappers := set{
+	PRECEDENCE00, PRECEDENCE0, PRECEDENCE1, PRECEDENCE2, PRECEDENCE3, PRECEDENCE4, PRECEDENCE5,
+	UNARYEXPR
+}
+
+// The operand inside the single-child precedence and unary nodes that
+// wrap it.
+func unwrapped(node) {
+	if isVector(node) && count(node) == 2 && kOperandWrappers  isContains  first(node) {
+		unwrapped(second(node))
+	} else {
+		node
+	}
+}
+
+// The identifiers bound by a destructuring form.
+func boundIdentifiers(destruct) {
+	switch first(destruct) {
+	case IDENTIFIER:
+		[destruct]
+	case TYPEDIDENTIFIER, VARIADICDESTRUCT, DICTDESTRUCTELEM:
+		boundIdentifiers(second(destruct))
+	case VECDESTRUCT, DICTDESTRUCT:
+		mapcat(boundIdentifiers, isVector  filter  rest(destruct))
+	default:
+		[]
+	}
+}
+
+kPlaceholder := [SYMBOL, [IDENTIFIER, "_"]]
+
+// A pipeline step that calls a function with _ as one of its
+// arguments becomes a pipeplaceholder node, a function of the piped
+// value which takes the place of the _.
+func placeholderStep(step) {
+	call   := unwrapped(step)
+	isCall := isVector(call) && first(call) == FUNCTIONCALL && count(call) == 3 &&
+		first(call[2]) == EXPRESSIONLIST
+	args   := if isCall { rest(call[2]) } else { [] }
+	if some(func{unwrapped($1) == kPlaceholder}, args) {
+		piped := for arg := lazy args {
+			if unwrapped(arg) == kPlaceholder { [SYMBOL, [IDENTIFIER, "anglx-it"]] } else { arg }
+		}
+		[PIPEPLACEHOLDER, [FUNCTIONCALL, call[1], vec(EXPRESSIONLIST  cons  piped)]]
+	} else {
+		step
+	}
+}
+
+// Replace the pipeline steps that have an _ placeholder argument by
+// pipeplaceholder nodes.
+func pipePlaceholders(node) {
+	switch {
+	case !isVector(node):
+		node
+	case first(node) == PIPE: {
+		[_, initial, steps...] := vec(for c := lazy node { pipePlaceholders(c) })
+		vec(concat([PIPE, initial], mapcat(func([op, step]) { [op, placeholderStep(step)] }, partition(2, steps))))
+	}
+	default:
+		vec(for c := lazy node { pipePlaceholders(c) })
+	}
+}
+
+// Turn the argument lists of function calls into namedargs nodes, so
+// that calls to functions with default parameters can be checked.
+func namedArguments(node) {
+	switch {
+	case !isVector(node):
+		node
+	case first(node) == FUNCTIONCALL && (count(node) == 2 || first(node[2]) == EXPRESSIONLIST): {
+		args := if count(node) == 3 { rest(node[2]) } else { [] }
+		[FUNCTIONCALL, namedArguments(node[1]), vec(NAMEDARGS  cons  (namedArguments  map  args))]
+	}
+	default:
+		vec(namedArguments  map  node)
+	}
+}
+
+// The required parameters, the default parameters and the rest of a
+// kwfunctionpart node.
+func defaultParts(part) {
+	params := rest(part)
+	if first(first(params)) == PARAMETERS {
+		[rest(first(params)), rest(second(params)), drop(2, params)]
+	} else {
+		[[], rest(first(params)), rest(params)]
+	}
+}
+
+func isPositionalDefault(node) {
+	first(node) == POSITIONALDEFAULT
+}
+
+// The parts of a function for a part that may have positional
+// defaults: one for each number of arguments, where each of the
+// shorter ones calls the next, by the name, with the default of its
+// missing parameter.  This way callers, even in other packages, do not
+// need its signature.  If there are named defaults too, the longest
+// part takes them as keywords, and a positional parameter given as
+// :anglx/default, as a call with named arguments does for those it
+// leaves out, takes its default.
+func defaultArityParts(nameNode, part) {
+	[required, defaults, more] := defaultParts(part)
+	if first(part) != KWFUNCTIONPART || !some(isPositionalDefault, defaults) {
+		[part]
+	} else {
+		positional := vec(filter(isPositionalDefault, defaults))
+		named      := remove(isPositionalDefault, defaults)
+		typ        := filter(func{first($1) == TYPENAME}, more)
+		names      := for [i, param] := lazy mapIndexed(vector, concat(required, positional)) {
+			switch first(param) {
+			case IDENTIFIER:                         param
+			case TYPEDIDENTIFIER, POSITIONALDEFAULT: second(param)
+			default:                                 [IDENTIFIER, str("anglxArg", i)]
+			}
+		}
+		arity := func(n) {
+			args := concat(for p := lazy take(n, names) { [SYMBOL, p] }, [positional[n - count(required)][2]])
+			call := [FUNCTIONCALL, [SYMBOL, nameNode], vec(EXPRESSIONLIST  cons  args)]
+			if n == 0 {
+				vec(concat([FUNCTIONPART0], typ, [call]))
+			} else {
+				vec(concat([FUNCTIONPARTN, vec(PARAMETERS  cons  take(n, names))], typ, [call]))
+			}
+		}
+		params := vec(PARAMETERS  cons  concat(required, map(second, positional)))
+		full   := if isEmpty(named) {
+			vec(concat([FUNCTIONPARTN, params], more))
+		} else {
+			body := [DEFAULTEDBODY, vec(DEFAULTPARAMS  cons  positional), last(more)]
+			vec(concat([KWFUNCTIONPART, params, vec(DEFAULTPARAMS  cons  named)], butlast(more), [body]))
+		}
+		concat(arity  map  \`range`(count(required), count(names)), [full])
+	}
+}
+
+// The number of parameters of a part that is not variadic.
+func fixedArity(part) {
+	switch first(part) {
+	case FUNCTIONPART0: 0
+	case FUNCTIONPARTN: count(rest(second(part)))
+	default:            nil
+	}
+}
+
+// The function, either a single part or several, with each part that
+// has positional defaults replaced by its arities.
+func defaultFunction(description, nameNode, function) {
+	parts    := if first(function) == FUNCTIONPARTS { rest(function) } else { [function] }
+	expanded := mapcat(func{defaultArityParts(nameNode, $1)}, parts)
+	if count(expanded) == count(parts) {
+		function
+	} else {
+		for [n, k] := range frequencies(keep(fixedArity, expanded)) {
+			if k > 1 {
+				throw(new IOException(str(description, " has more than one arity with ", n, " parameters")))
+			}
+		}
+		vec(FUNCTIONPARTS  cons  expanded)
+	}
+}
+
+// Turn each function declared or written as a literal with positional
+// default parameters into a function with several arities.  A literal
+// is given a name so that its shorter arities can call the longer.
+func defaultArities(node) {
+	if !isVector(node) {
+		node
+	} else {
+		children := vec(defaultArities  map  node)
+		switch first(children) {
+		case FUNCTIONDECL:
+			assoc(children, 2, defaultFunction(str("function ", second(children[1])), children[1], children[2]))
+		case FUNCTIONLIT: {
+			self     := [IDENTIFIER, "anglxSelf"]
+			function := defaultFunction("function literal", self, children[1])
+			if function == children[1] { children } else { [NAMEDFUNCTIONLIT, self, function] }
+		}
+		default:
+			children
+		}
+	}
+}
+
+// Add to the symbol table the signature of each function declared with
+// default parameters.
+func declareSignatures(symbolTable, codeGen, parsed) {
+	isDecl := func(node) {
+		isVector(node) && first(node) == FUNCTIONDECL && first(node[2]) == KWFUNCTIONPART
+	}
+	for node := range isDecl  filter  treeSeq(isVector, seq, parsed) {
+		[_, nameNode, part]      := node
+		[required, defaults, _]  := defaultParts(part)
+		name                     := func{insta.transform(codeGen, second($1))}
+		symbols.SignatureCreated(symbolTable, insta.transform(codeGen, nameNode), {
+			REQUIRED: count(required),
+			OPTIONAL: count(filter(isPositionalDefault, defaults)),
+			NAMES:    set(name  map  remove(isPositionalDefault, defaults))
+		})
+	}
+}
+
+// The spec predicates of types that have one.
+kSpecPredicates := {
+	"long": "int?", "byte": "int?", "short": "int?", "double": "double?",
+	"char": "char?", "boolean": "boolean?", "String": "string?"
+}
+
+// The [name type] pairs of the fields node of a struct, with a nil
+// type for an untyped field.
+func fieldTypes(codeGen, fields) {
+	mapcat(func(field) {
+		switch first(field) {
+		case FIELDS:
+			fieldTypes(codeGen, field)
+		case TYPEDIDENTIFIERS:
+			typ := insta.transform(codeGen, last(field))
+			for identifier := lazy butlast(rest(field)) { [insta.transform(codeGen, identifier), typ] }
+		default:
+			[[insta.transform(codeGen, field), nil]]
+		}
+	}, rest(fields))
+}
+
+// The spec of the arguments of one arity of a function, as a
+// [tag spec] pair for anglx-spec/alt, together with its return spec.
+func aritySpec(codeGen, typeSpec, part) {
+	ofRule   := func(rule) {
+		first(filter(func{isVector($1) && first($1) == rule}, butlast(rest(part))))
+	}
+	params   := rest(ofRule(PARAMETERS))
+	isRest   := ofRule(VARIADIC) || ofRule(DEFAULTPARAMS)
+	args     := for [i, param] := lazy mapIndexed(vector, params) {
+		switch first(param) {
+		case IDENTIFIER:
+			[":"  str  insta.transform(codeGen, param), "any?"]
+		case TYPEDIDENTIFIER:
+			[":"  str  insta.transform(codeGen, second(param)), typeSpec(param[2])]
+		default:
+			[str(":arg", i), "any?"]
+		}
+	}
+	more     := if isRest { [":more", listStr("anglx-spec/*", "any?")] } else { [] }
+	ret      := ofRule(TYPENAME)
+	{
+		TAG:     if isRest { ":variadic" } else { str(":arity-", count(params)) },
+		ARGS:    listStr("anglx-spec/cat", ...concat(apply(concat, args), more)),
+		RET:     if ret { typeSpec(ret) },
+		IS_TYPED: ret || some(func{first($1) == TYPEDIDENTIFIER}, params)
+	}
+}
+
+// Return the anglx-spec definitions of the structs and typed functions
+// in the tree, followed if isValidate by the instrumentation of the
+// public functions among them.
+func specDefinitions(codeGen, tree, ns, isValidate) {
+	nodes       := func(rule) {
+		filter(func{isVector($1) && first($1) == rule}, treeSeq(isVector, seq, tree))
+	}
+	structs     := set(for [_, name] := lazy nodes(STRUCTSPEC) { name })
+	specOf      := func(typ) {
+		switch {
+		case !typ:                             "any?"
+		case kSpecPredicates  isContains  typ: kSpecPredicates(typ)
+		case structs  isContains  typ:         str(":", ns, "/", typ)
+		default:                               listStr("partial", "instance?", typ)
+		}
+	}
+	typeSpec    := func(typeNode) { specOf(insta.transform(codeGen, typeNode)) }
+	structSpecs := for [_, name, fields] := lazy nodes(STRUCTSPEC) {
+		hasFields := isVector(fields) && first(fields) == FIELDS
+		pairs     := if hasFields { fieldTypes(codeGen, fields) } else { [] }
+		keys      := for [field, _] := lazy pairs { str(":", ns, ".", name, "/", field) }
+		blankJoin(
+			...concat(
+				for [key, [_, typ]] := lazy map(vector, keys, pairs) {
+					listStr("anglx-spec/def", key, specOf(typ))
+				},
+				[listStr("anglx-spec/def", str(":", ns, "/", name),
+					listStr("anglx-spec/keys", ":req-un", vecStr(...keys)))]
+			)
+		)
+	}
+	isNamed   := func{first(second($1)) == IDENTIFIER}
+	functions := for [_, nameNode, function] := lazy isNamed  filter  nodes(FUNCTIONDECL) {
+		arities := if first(function) == FUNCTIONPARTS { rest(function) } else { [function] }
+		specs   := for part := lazy arities { aritySpec(codeGen, typeSpec, part) }
+		rets    := distinct(RET  map  specs)
+		[insta.transform(codeGen, nameNode), specs, if count(rets) == 1 { first(rets) }]
+	}
+	typed     := filter(func{some(IS_TYPED, second($1))}, functions)
+	fdefs     := for [name, specs, ret] := lazy typed {
+		args := if count(specs) == 1 {
+			ARGS(first(specs))
+		} else {
+			listStr("anglx-spec/alt", ...mapcat(func{[TAG($1), ARGS($1)]}, specs))
+		}
+		listStr("anglx-spec/fdef", name, ":args", args, ...(if ret { [":ret", ret] } else { [] }))
+	}
+	public    := for [name] := lazy typed if isPublic(name) { str("'", ns, "/", name) }
+	instrument := if isValidate && notEmpty(public) {
+		[listStr("anglx-spec-test/instrument", vecStr(...public))]
+	} else {
+		[]
+	}
+	blankJoin(...concat(structSpecs, fdefs, instrument))
+}
+
+// Add to the symbol table each var declared in this file, noting
+// which are dynamic.  A var annotated with @dynamic is not recorded,
+// so it can be rebound but does not get earmuffs.
+func declareVars(symbolTable, tree) {
+	isDynamicAnnotated := func(node) {
+		some(func(child) {
+			isVector(child) && first(child) == ANNOTATIONS &&
+				some(func{$1 == [ANNOTATION, [IDENTIFIER, "dynamic"]]}, rest(child))
+		}, rest(node))
+	}
+	varRules := set{VARDECL1, VARDECL2, STATEVARDECL, DYNAMICVARDECL}
+	isVar    := func(node) { isVector(node) && (varRules  isContains  first(node)) }
+	for node := range isVar  filter  treeSeq(isVector, seq, tree) {
+		names := take(if first(node) == VARDECL2 { 2 } else { 1 }, rest(node))
+		for [rule, name] := range names {
+			if rule == IDENTIFIER && !isDynamicAnnotated(node) {
+				symbols.VarCreated(symbolTable, name, first(node) == DYNAMICVARDECL)
+			}
+		}
+	}
+}
+
+// Throw an exception if a var declared in this file without being
+// dynamic is rebound.
+func checkRebinds(symbolTable, tree) {
+	for node := range treeSeq(isVector, seq, tree) {
+		if isVector(node) && first(node) == REBINDING {
+			[_, [_, [rule, name], qualified]] := node
+			if rule == IDENTIFIER && !qualified && symbols.IsStaticVar(symbolTable, name) {
+				throw(new IOException(str("var ", name, " is rebound but is not declared dynamic")))
+			}
+		}
+	}
+}
+
+// Append to the fields of each value struct a fieldtypes node with the
+// name and any type of each of its immutable fields, which are the ones
+// that take part in its equality.
+func valueFieldTypes(node) {
+	switch {
+	case !isVector(node):
+		node
+	case first(node) == VALUEFIELDS: {
+		pairs := mapcat(func(field) {
+			switch first(field) {
+			case IDENTIFIER:
+				[[FIELDTYPE, field]]
+			case TYPEDIDENTIFIERS:
+				for identifier := lazy butlast(rest(field)) { [FIELDTYPE, identifier, last(field)] }
+			default:
+				[]
+			}
+		}, rest(node))
+		node  conj  vec(FIELDTYPES  cons  pairs)
+	}
+	default:
+		vec(valueFieldTypes  map  node)
+	}
+}
+
+// Rules whose last child is the body of a function.
+kFunctionBodyRules := set{
+	FUNCTIONPART0, FUNCTIONPARTN, VFUNCTIONPART0, VFUNCTIONPARTN, KWFUNCTIONPART,
+	SHORTFUNCTIONLIT, UNTYPEDMETHODIMPL, TYPEDMETHODIMPL, RECEIVERDECL
+}
+
+// Does the node use ? outside any function nested in it?
+func usesCheck(node) {
+	isVector(node) && !(kFunctionBodyRules  isContains  first(node)) &&
+		(first(node) == CHECKED || some(usesCheck, rest(node)))
+}
+
+// Rules that a recur inside them goes back to.
+kRecurTargets := into(kFunctionBodyRules, [LOOP, FORNUMERIC, FORLOOP])
+
+func isRecur(node) {
+	isVector(node) && first(node) == FUNCTIONCALL && node[1] == [SYMBOL, [IDENTIFIER, "recur"]]
+}
+
+// The numbers of arguments of the recurs to the function whose body
+// this is.
+func recurArities(node) {
+	switch {
+	case !isVector(node) || kRecurTargets  isContains  first(node):
+		[]
+	case isRecur(node):
+		[count(rest(node[2]))]
+	default:
+		mapcat(recurArities, rest(node))
+	}
+}
+
+// Replace the recurs to the function whose body this is by
+// errorscoperecur nodes holding their arguments.
+func scopeRecurs(node) {
+	switch {
+	case !isVector(node) || kRecurTargets  isContains  first(node):
+		node
+	case isRecur(node):
+		vec(ERRORSCOPERECUR  cons  rest(node[2]))
+	default:
+		vec(for c := lazy node { scopeRecurs(c) })
+	}
+}
+
+// Wrap the body of each function that uses ? in an errorscope node,
+// which returns the error of a failed check as the error of a [value,
+// error] result.  A recur to the function is done outside the scope,
+// so the errorscope is also given its number of arguments.  A ?
+// outside any function is an error.
+func errorScopes(node, isInFunction) {
+	if !isVector(node) {
+		node
+	} else {
+		tag := first(node)
+		switch {
+		case tag == CHECKED && !isInFunction:
+			throw(new IOException("? can only be used inside a function"))
+		case kFunctionBodyRules  isContains  tag: {
+			children := vec(for c := lazy rest(node) { errorScopes(c, true) })
+			body     := peek(children)
+			if usesCheck(last(node)) {
+				scope := if arity := first(recurArities(body)); arity {
+					[ERRORSCOPE, scopeRecurs(body), arity]
+				} else {
+					[ERRORSCOPE, body]
+				}
+				vec(tag  cons  (pop(children)  conj  scope))
+			} else {
+				vec(tag  cons  children)
+			}
+		}
+		default:
+			vec(tag  cons  (for c := lazy rest(node) { errorScopes(c, isInFunction) }))
+		}
+	}
+}
+
+kSliceRules := set{INDEXED, TAKESLICE, DROPSLICE, SLICE}
+
+// STRING or VECTOR if the type is a string or a persistent vector.
+func typeKind([_, segments...]) {
+	switch {
+	case segments == [[STRING]] || segments == ["String"] || segments == ["java", "lang", "String"]:
+		STRING
+	case set{"IPersistentVector", "APersistentVector", "PersistentVector"}(last(segments)):
+		VECTOR
+	default:
+		nil
+	}
+}
+
+// The kind of the operand of a slice, if it is a literal or a name
+// declared with a string or vector type in the enclosing function.
+func operandKind(operand, kinds) {
+	switch {
+	case !isVector(operand):
+		nil
+	case set{INTERPRETEDSTRINGLIT, RAWSTRINGLIT}(first(operand)):
+		STRING
+	case first(operand) == VECLIT:
+		VECTOR
+	case first(operand) == SYMBOL && count(operand) == 2:
+		kinds(second(operand))
+	default:
+		nil
+	}
+}
+
+// POSITIVE or NEGATIVE if the expression is a number literal, possibly
+// negated, otherwise nil.
+func literalSign(expr) {
+	operand := unwrapped(expr)
+	switch {
+	case isString(operand):
+		if reMatches(/0[0-7]+/, operand) { POSITIVE }
+	case !isVector(operand):
+		nil
+	case set{DECIMALLIT, HEXLIT, FLOATLIT, BIGINTLIT, BIGFLOATLIT}  isContains  first(operand):
+		POSITIVE
+	case first(operand) == UNARYEXPR && second(operand) == "-" && literalSign(operand[2]) == POSITIVE:
+		NEGATIVE
+	}
+}
+
+// Is the expression known to be an integer when compiling: an integer
+// literal, possibly negated, or a count?
+func isIntegral(expr) {
+	operand := unwrapped(expr)
+	switch {
+	case isString(operand):
+		reMatches(/0[0-7]+/, operand)
+	case !isVector(operand):
+		false
+	case set{DECIMALLIT, HEXLIT, LEN}  isContains  first(operand):
+		true
+	case first(operand) == FUNCTIONCALL:
+		operand[1] == [SYMBOL, [IDENTIFIER, "count"]]
+	case first(operand) == UNARYEXPR && second(operand) == "-":
+		isIntegral(operand[2])
+	default:
+		false
+	}
+}
+
+// Is the expression a name or a literal, which need not be bound to a
+// local to be evaluated only once?
+func isSimple(expr) {
+	operand := unwrapped(expr)
+	isVector(operand) && first(operand) == SYMBOL || literalSign(operand)
+}
+
+// Add to each with block a resources node for each of its bindings,
+// holding the names bound by a destructured resource, each of which is
+// closed, or nothing for a resource that is not destructured.
+func withResources(node) {
+	if !isVector(node) {
+		node
+	} else {
+		annotated := vec(for c := lazy node { withResources(c) })
+		if first(node) == WITHOPEN {
+			[_, [rule, destructs...]] := node
+			lhss := if rule == WITHSINGLE { [first(destructs)] } else { takeWhile(isVector, destructs) }
+			annotated  conj  vec(DESTRUCTUREDRESOURCES  cons  (for d := lazy lhss {
+				isDestructured := set{VECDESTRUCT, DICTDESTRUCT}  isContains  first(d)
+				vec(RESOURCES  cons  (if isDestructured { boundIdentifiers(d) } else { [] }))
+			}))
+		} else {
+			annotated
+		}
+	}
+}
+
+// Add to each numeric and c-style loop a map of what is known when
+// compiling about its bounds and step: IS_INTEGRAL if they are all
+// integers, so that the counter can be a primitive long, and for a
+// numeric loop the DIRECTION, UP or DOWN, if the step is a literal.
+func annotateLoops(node) {
+	if !isVector(node) {
+		node
+	} else {
+		annotated := vec(for c := lazy node { annotateLoops(c) })
+		switch first(node) {
+		case FORNUMERIC: {
+			[_, _, start, _, end, more...] := node
+			step      := if count(more) == 2 { first(more) }
+			direction := switch {
+			case !step:                         UP
+			case literalSign(step) == POSITIVE: UP
+			case literalSign(step) == NEGATIVE: DOWN
+			}
+			annotated  conj  {
+				IS_INTEGRAL:    isEvery(isIntegral, remove(isNil, [start, end, step])),
+				DIRECTION:      direction,
+				IS_SIMPLE_END:  isSimple(end),
+				IS_SIMPLE_STEP: !step || isSimple(step)
+			}
+		}
+		case FORLOOP: {
+			[_, _, init, _, step] := node
+			isIntegralStep := switch first(step) {
+			case INCREMENT, DECREMENT: true
+			default:                   isIntegral(step[2])
+			}
+			annotated  conj  {IS_INTEGRAL: isIntegral(init) && isIntegralStep}
+		}
+		default:
+			annotated
+		}
+	}
+}
+
+// An index written as -n becomes a fromend node, counting from the
+// end.  Only a literal n can count from the end, so that which indices
+// do is known when compiling.
+func fromEndIndex(index) {
+	operand := unwrapped(index)
+	if isVector(operand) && first(operand) == UNARYEXPR && second(operand) == "-" {
+		n := unwrapped(operand[2])
+		if isVector(n) && first(n) == DECIMALLIT {
+			[FROMEND, second(n)]
+		} else {
+			throw(new IOException("only a literal index like -1 can count from the end"))
+		}
+	} else {
+		index
+	}
+}
+
+// Add the kind of the operand, STRING or VECTOR, as an extra child of
+// each slice or index whose operand is known to be a string or vector,
+// so that it can use subs or subvec.
+func annotateSlices(node, kinds) {
+	switch {
+	case !isVector(node):
+		node
+	case kFunctionBodyRules  isContains  first(node): {
+		typed     := for n := lazy treeSeq(isVector, seq, node) if isVector(n) && first(n) == TYPEDIDENTIFIER {
+			[n[1], typeKind(n[2])]
+		}
+		withTyped := into(kinds, for [identifier, kind] := lazy typed if kind { [identifier, kind] })
+		vec(for c := lazy node { annotateSlices(c, withTyped) })
+	}
+	case kSliceRules  isContains  first(node): {
+		[tag, xs, indices...] := vec(for c := lazy node { annotateSlices(c, kinds) })
+		annotated := vec(concat([tag, xs], map(fromEndIndex, indices)))
+		if kind := operandKind(node[1], kinds); kind {
+			annotated  conj  kind
+		} else {
+			annotated
+		}
+	}
+	default:
+		vec(for c := lazy node { annotateSlices(c, kinds) })
+	}
+}
+
+func isDosync(node) {
+	switch first(node) {
+	case PREFIXEDBLOCK, PREFIXEDROUTINE:
+		node[1] == [PREFIX, "dosync"]
+	case FUNCTIONCALL:
+		node[1] == [SYMBOL, [IDENTIFIER, "dosync"]]
+	default:
+		false
+	}
+}
+
+// Is the node the name of an atom, ref or agent?
+func isState(node, states) {
+	isVector(node) && first(node) == SYMBOL && count(node) == 2 && states(second(node))
+}
+
+// The rules that bind names, each with a function returning the
+// destructuring forms it binds.
+kBindingForms := {
+	PARAMETERS:        rest,
+	MULTIPLEASSIGN:    func{takeWhile(isVector, rest($1))},
+	WITHMULTIPLE:      func{takeWhile(isVector, rest($1))},
+	CATCH:             func{[$1[2]]},
+	VARIADIC:          func{[second($1)]},
+	POSITIONALDEFAULT: func{[second($1)]},
+	NAMEDDEFAULT:      func{[second($1)]},
+	RECEIVER:          func{[second($1)]},
+	CONST:             func{[second($1)]},
+	SINGLEASSIGN:      func{[second($1)]},
+	WITHSINGLE:        func{[second($1)]},
+	LETIFELSEEXPR:     func{[second($1)]},
+	LETCONSTSWITCH:    func{[second($1)]},
+	FORRANGE:          func{[second($1)]},
+	FORLAZY:           func{[second($1)]},
+	FORBINDING:        func{[second($1)]},
+	FORLET:            func{[second($1)]},
+	FORTIMES:          func{[second($1)]},
+	FORNUMERIC:        func{[second($1)]},
+	FORLOOP:           func{[second($1)]},
+	FORCSTYLE:         func{[second($1)]}
+}
+
+// Rules whose names are bound only inside them.
+kScopeRules := into(kFunctionBodyRules, [
+	WITHCONST, WITHASSIGN, TOPWITHCONST, TOPWITHASSIGN, LOOP, WITHOPEN, CATCH,
+	LETIFELSEEXPR, LETCONSTSWITCH, FORRANGE, FORLAZY, FORTIMES, FORNUMERIC, FORLOOP, FORCSTYLE
+])
+
+// The identifiers bound in the scope of the node, leaving out those
+// bound in the scopes nested in it.
+func scopeIdentifiers(node) {
+	form := kBindingForms(first(node))
+	concat(
+		if form { mapcat(boundIdentifiers, form(node)) } else { [] },
+		mapcat(
+			func(child) { if kScopeRules  isContains  first(child) { [] } else { scopeIdentifiers(child) } },
+			isVector  filter  rest(node)
+		)
+	)
+}
+
+kResult := [SYMBOL, [IDENTIFIER, "result"]]
+
+func isResultBound(identifiers) {
+	some(func{$1 == second(kResult)}, identifiers)
+}
+
+// Replace result in each postcondition by %, which Clojure binds to
+// the value returned, except inside a func{...} that has its own %,
+// and where a parameter or local named result hides it.
+func postconditionResults(node, isResult) {
+	switch {
+	case !isVector(node):
+		node
+	case isResult && node == kResult:
+		[PERCENT]
+	case first(node) == SHORTFUNCTIONLIT:
+		node
+	case kFunctionBodyRules  isContains  first(node): {
+		isParam := isResultBound(mapcat(scopeIdentifiers, isVector  filter  butlast(rest(node))))
+		vec(for c := lazy node {
+			if isVector(c) && first(c) == CONDITIONS {
+				vec(for p := lazy c {
+					postconditionResults(p, !isParam && isVector(p) && first(p) == POSTCONDITION)
+				})
+			} else {
+				postconditionResults(c, isResult && !isParam)
+			}
+		})
+	}
+	default: {
+		isHidden := (kScopeRules  isContains  first(node)) && isResultBound(scopeIdentifiers(node))
+		vec(for c := lazy node { postconditionResults(c, isResult && !isHidden) })
+	}
+	}
+}
+
+// Move the conditions of each function part into a conditionedbody
+// node around its body, in front of which they go.
+func conditionedBodies(node) {
+	if !isVector(node) {
+		node
+	} else {
+		children    := vec(conditionedBodies  map  node)
+		isCondition := func{isVector($1) && first($1) == CONDITIONS}
+		conditions  := first(filter(isCondition, children))
+		if (kFunctionBodyRules  isContains  first(node)) && conditions {
+			others := vec(remove(isCondition, children))
+			pop(others)  conj  [CONDITIONEDBODY, conditions, peek(others)]
+		} else {
+			children
+		}
+	}
+}
+
+func declaredDynamics(parsed) {
+	set(for n := lazy treeSeq(isVector, seq, parsed) if isVector(n) && first(n) == DYNAMICVARDECL {
+		n[1]
+	})
+}
+
+// Mark the declarations of the vars declared dynamic, and the
+// unqualified names that refer to them, as dynamicidentifier nodes.
+// A local with the same name hides the var.
+func dynamicReferences(node, dynamics) {
+	if !isVector(node) {
+		node
+	} else {
+		inScope  := if kScopeRules  isContains  first(node) {
+			apply(disj, dynamics, scopeIdentifiers(node))
+		} else {
+			dynamics
+		}
+		marked   := func(identifier) {
+			if inScope(identifier) { [DYNAMICIDENTIFIER, second(identifier)] } else { identifier }
+		}
+		children := for c := lazy rest(node) { dynamicReferences(c, inScope) }
+		switch {
+		case first(node) == SYMBOL && count(node) == 2:
+			[SYMBOL, marked(second(node))]
+		case first(node) == DYNAMICVARDECL:
+			vec(concat([DYNAMICVARDECL, marked(second(node))], rest(children)))
+		default:
+			vec(first(node)  cons  children)
+		}
+	}
+}
+
+func checkInDosync(kind, [_, name], isUnguarded) {
+	if kind == "ref" && isUnguarded {
+		throw(new IOException(str("ref ", name, " is altered outside dosync")))
+	}
+}
+
+// Rules whose bodies may run anywhere, as far as this package can see.
+kOpaqueFunctionRules := set{
+	FUNCTIONLIT, NAMEDFUNCTIONLIT, SHORTFUNCTIONLIT, METHODDECL, MACRODECL, FUNCLIKEDECL,
+	RECEIVERDECL, UNTYPEDMETHODIMPL, TYPEDMETHODIMPL
+}
+
+// The references to unqualified names in the tree, each with the
+// context it is in: the name, whether it is called, whether it is in a
+// dosync, the declared function it is in, and whether it is in a
+// function that may run anywhere.
+func functionReferences(node, context) {
+	if !isVector(node) {
+		[]
+	} else {
+		tag   := first(node)
+		inner := dissoc(switch {
+			case isDosync(node):                          context += {IS_IN_DOSYNC: true}
+			case tag == FUNCTIONDECL:                     dissoc(context += {FUNCTION: node[1]}, IS_OPAQUE)
+			case kOpaqueFunctionRules  isContains  tag:   context += {IS_OPAQUE: true}
+			default:                                      context
+		}, IS_CALL)
+		switch {
+		case tag == SYMBOL && isVector(second(node)) && first(second(node)) == IDENTIFIER:
+			[context += {NAME: second(node)}]
+		case tag == FUNCTIONCALL:
+			concat(
+				functionReferences(node[1], inner += {IS_CALL: true}),
+				mapcat(func{functionReferences($1, inner)}, drop(2, node))
+			)
+		default:
+			mapcat(func{functionReferences($1, inner)}, rest(node))
+		}
+	}
+}
+
+// The names of the private functions declared with func that are
+// never called inside a dosync, neither directly nor through other
+// functions, so that a ref they change is changed outside a
+// transaction.  A function that is public, used as a value, or called
+// from a function literal or method may be called anywhere.
+func neverInDosync(tree) {
+	refs      := functionReferences(tree, {})
+	decls     := for n := lazy treeSeq(isVector, seq, tree) if isVector(n) && first(n) == FUNCTIONDECL && first(n[1]) == IDENTIFIER {
+		n[1]
+	}
+	isPrivate := func([_, name]) { reFind(/^\p{Ll}/, name) && name != "main" }
+	calls     := reduce(func(acc, r) {
+		if FUNCTION(r) { updateIn(acc, [FUNCTION(r)], fnil(conj, set{}), NAME(r)) } else { acc }
+	}, {}, refs)
+	start     := set(concat(
+		for r := lazy refs if IS_IN_DOSYNC(r) || IS_OPAQUE(r) || !IS_CALL(r) { NAME(r) },
+		remove(isPrivate, decls)
+	))
+	anywhere  := loop(names = start) {
+		more := into(names, mapcat(calls, names))
+		if more == names { names } else { recur(more) }
+	}
+	set(remove(anywhere, filter(isPrivate, decls)))
+}
+
+// Replace the updates and assignments of the atoms, refs and agents
+// declared with var by stateupdate, stateupdatecall and stateassign
+// nodes that say which kind of state they change.  A local with the
+// same name hides the var.  A ref changed by a top-level form, or by a
+// function that is never called inside a dosync, must be inside a
+// dosync; one changed in any other function is left to the runtime
+// check, as the function may be called inside a dosync.
+func stateChanges(node, states, outsideDosync, isUnguarded, isOutsidePart) {
+	if !isVector(node) {
+		node
+	} else {
+		tag      := first(node)
+		inScope  := if kScopeRules  isContains  tag {
+			apply(dissoc, states, scopeIdentifiers(node))
+		} else {
+			states
+		}
+		guarded  := isDosync(node) || (kFunctionBodyRules  isContains  tag && !isOutsidePart)
+		isOutside := (tag == FUNCTIONDECL && outsideDosync  isContains  node[1]) || (isOutsidePart && tag == FUNCTIONPARTS)
+		children := vec(for c := lazy rest(node) {
+			stateChanges(c, inScope, outsideDosync, isUnguarded && !guarded, isOutside)
+		})
+		[left, op, right] := children
+		[target, value]   := [unwrapped(left), unwrapped(right)]
+		switch {
+		case first(node) == PRECEDENCE00 && op == [SENDOP] && isState(target, inScope): {
+			kind := inScope(second(target))
+			checkInDosync(kind, second(target), isUnguarded)
+			if first(value) == FUNCTIONCALL && count(value) == 3 {
+				[STATEUPDATECALL, kind, target, value[1], value[2]]
+			} else {
+				[STATEUPDATE, kind, target, right]
+			}
+		}
+		case first(node) == STATEASSIGN: {
+			kind := inScope(left)
+			if !kind {
+				throw(new IOException(str(second(left), " is not declared as an atom, ref or agent")))
+			}
+			checkInDosync(kind, left, isUnguarded)
+			[STATEASSIGN, kind, left, op]
+		}
+		default:
+			vec(first(node)  cons  children)
+		}
+	}
+}
+
+func declaredStates(parsed) {
+	into({}, for n := lazy treeSeq(isVector, seq, parsed) if isVector(n) && first(n) == STATEVARDECL {
+		[n[1], n[2]]
+	})
+}
+
+kTopLevelRules := set{SOURCEFILE, NONPKGFILE, TOPWITHCONST, TOPWITHASSIGN}
+
+func isDefer(node) {
+	isVector(node) && first(node) == DEFERSTMT
+}
+
+// Return the expressions of a left-recursive expressions node as a flat
+// sequence.
+func flatExpressions(node) {
+	loop(n = node, acc = ()) {
+		if count(n) == 3 {
+			recur(n[1], n[2]  cons  acc)
+		} else {
+			n[1]  cons  acc
+		}
+	}
+}
+
+// Group each defer with the expressions that follow it, so that it can
+// be generated as a try whose finally runs the deferred expression.
+func withDeferred(exprs) {
+	[before, after] := splitWith(func{!isDefer($1)}, exprs)
+	if isEmpty(after) {
+		before
+	} else {
+		[[_, deferred], remaining...] := after
+		before  concat  [vec(DEFERRED  cons  (deferred  cons  withDeferred(remaining)))]
+	}
+}
+
+// Replace each defer statement and the rest of its function body or
+// block by a deferred node.  A defer at top level is an error.
+func liftDefers(node, isTopLevel) {
+	if !isVector(node) {
+		node
+	} else {
+		tag := first(node)
+		switch tag {
+		case EXPRESSIONS, BLOCK: {
+			children := if tag == EXPRESSIONS { flatExpressions(node) } else { rest(node) }
+			exprs    := for e := lazy children { liftDefers(e, false) }
+			if isTopLevel && some(isDefer, exprs) {
+				throw(new IOException("defer is not allowed at top level"))
+			}
+			vec(tag  cons  withDeferred(exprs))
+		}
+		default:
+			vec(tag  cons  (for c := lazy rest(node) {
+				liftDefers(c, kTopLevelRules  isContains  tag)
+			}))
+		}
+	}
+}
+
+func isReceiverDecl(node) {
+	isVector(node) && first(node) == RECEIVERDECL
+}
+
+// Replace the receiver methods in the top-level expressions by a
+// receiverprotocols node, declaring a protocol for each method name,
+// where the first of them is declared, and a receivermethods node per
+// receiver type, extending the type where its first method is declared.
+func regroupReceivers(exprs) {
+	receiverType := func(decl) { last(decl[1]) }
+	decls        := isReceiverDecl  filter  exprs
+	byType       := receiverType  groupBy  decls
+	asMethod     := func(decl) { vec(RECEIVERMETHOD  cons  rest(decl)) }
+	mapcat(func(e) {
+		switch {
+		case !isReceiverDecl(e):
+			[e]
+		case !isIdentical(e, first(byType(receiverType(e)))):
+			[]
+		default: {
+			methods := vec([RECEIVERMETHODS, receiverType(e)]  concat  (asMethod  map  byType(receiverType(e))))
+			if isIdentical(e, first(decls)) {
+				[vec(RECEIVERPROTOCOLS  cons  (asMethod  map  decls)), methods]
+			} else {
+				[methods]
+			}
+		}
+		}
+	}, exprs)
+}
+
+// Group the receiver methods declared at top level by their name, so
+// that each method name gets one protocol, which types that share the
+// name all extend.
+func groupReceivers(node) {
+	if isVector(node) && kTopLevelRules  isContains  first(node) {
+		vec(for child := lazy node {
+			switch {
+			case isVector(child) && first(child) == EXPRESSIONS:
+				vec(EXPRESSIONS  cons  regroupReceivers(rest(child)))
+			case isVector(child) && kTopLevelRules  isContains  first(child):
+				groupReceivers(child)
+			default:
+				child
+			}
+		})
+	} else {
+		node
+	}
+}
+
 // Return the Clojure code generated from the given parse tree.
-func Generate(path String, parsed, isSync) {
-	symbolTable := symbols.New()
-	isGoscript  := path->endsWith(".anxs")
-	isSync      := !usesAsync(parsed)
-	codeGen     := codeGenerator(symbolTable, isGoscript) += {
-		PACKAGECLAUSE:   packageclauseFunc(symbolTable, path, isGoscript, isSync),
-		IMPORTDECL:      importDeclFunc(isGoscript, isSync) ,
-		MACROIMPORTDECL: macroImportDeclFunc(isGoscript, isSync)
-	}
-	clj         := insta.transform(codeGen, parsed)
+func Generate(path String, parsed, isSync, source String) {
+	Generate(path, parsed, isSync, source, nil)
+} (path String, parsed, isSync, source String, specMode) {
+	symbolTable  := symbols.New()
+	isGoscript   := path->endsWith(".anxs")
+	rewritten    := namedArguments(defaultArities(pipePlaceholders(interpolateStrings(attachAnnotations(attachDocs(source, parsed))))))
+	ns           := apply(str, splitPath(path))
+	marked       := dynamicReferences(postconditionResults(rewritten, false), declaredDynamics(parsed))
+	changed      := stateChanges(marked, declaredStates(parsed), neverInDosync(marked), true, false)
+	tree         := conditionedBodies(groupReceivers(liftDefers(errorScopes(withResources(annotateLoops(annotateSlices(valueFieldTypes(changed), {}))), false), true)))
+	isSync       := !usesRules(kAsyncRules, tree)
+	isMatch      := usesRules(set{MATCHSTMT}, tree)
+	hasImports   := some(func{isVector($1) && first($1) == IMPORTDECL && count($1) > 1}, treeSeq(isVector, seq, tree))
+	codeGen      := codeGenerator(symbolTable, isGoscript) += {
+		PACKAGECLAUSE:   packageclauseFunc(symbolTable, path, isGoscript, isSync, isMatch, specMode),
+		IMPORTDECL:      importDeclFunc(isGoscript, isSync, isMatch, specMode),
+		MACROIMPORTDECL: macroImportDeclFunc(isGoscript, isSync, isMatch, specMode, hasImports)
+	}
+	declareVars(symbolTable, rewritten)
+	checkRebinds(symbolTable, rewritten)
+	declareSignatures(symbolTable, codeGen, parsed)
+	clj          := insta.transform(codeGen, tree)
+	specs        := if specMode {
+		specDefinitions(codeGen, tree, ns, specMode == VALIDATE)
+	}
 	symbols.CheckAllUsed(symbolTable)
-	clj
+	if isEmpty(specs) { clj } else { str(clj, " ", specs) }
 }
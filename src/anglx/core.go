@@ -30,6 +30,85 @@ func Ambiguity(fgo) {
   insta.parses(parser.Parse, preprocessed)
 }
 
+// Return the pairs of smallest subtrees at which two parse trees of
+// the same text differ.  A node whose own text differs (rather than
+// one of its children) is reported whole, so that it still has a span.
+func ParseTreeDiffs(a, b) {
+	if a == b {
+		[]
+	} else {
+		isSameRule := isVector(a) && isVector(b) &&
+			first(a) == first(b) && count(a) == count(b)
+		leavesMatch := isEvery(identity, map(
+			func{ isVector($1) || $1 == $2 },
+			rest(a),
+			rest(b)
+		))
+		if isSameRule && leavesMatch {
+			vec(mapcat(ParseTreeDiffs, rest(a), rest(b)))
+		} else {
+			[[a, b]]
+		}
+	}
+}
+
+// A compact rendering of a parse tree showing only the grammar rules,
+// down to the given depth.
+func ruleOutline(tree, depth) {
+	if isVector(tree) {
+		children := filter(isVector, rest(tree))
+		if depth == 0 || isEmpty(children) {
+			name(first(tree))
+		} else {
+			str(name(first(tree)), "(",
+				", "  string.join  (for child := lazy children {
+					ruleOutline(child, depth - 1)
+				}),
+				")")
+		}
+	} else {
+		prStr(tree)
+	}
+}
+
+// Return a description of where the span starts in the text, as line
+// and column of its first non-blank character, followed by the source
+// it covers.
+func describeSpan(text String, [start, end]) {
+	source String := subs(text, start, end)
+	trimmed       := string.trim(source)
+	begin         := start + source->indexOf(trimmed)
+	before String := subs(text, 0, begin)
+	line          := 1 + count(func{ $1 == '\n' }  filter  before)
+	column        := begin - before->lastIndexOf(int('\n'))
+	snippet       := string.replace(trimmed, /\s+/, " ")
+	str("line ", line, ", column ", column, ": ",
+		if count(snippet) > 60 {
+			subs(snippet, 0, 57)  str  "..."
+		} else {
+			snippet
+		})
+}
+
+// Print, for each alternative parse, the regions where it differs from
+// the first parse (which is the one used) and the grammar rules that
+// each of them matched there.
+func explainAmbiguity(text, parsedList) {
+	chosen := parsedList[0]
+	for [i, alternative] := range mapIndexed(vector, rest(parsedList)) {
+		println()
+		println("  alternative", i + 2, "of", count(parsedList), "differs from the chosen parse")
+		for [ours, theirs] := range ParseTreeDiffs(chosen, alternative) {
+			span := insta.span(ours) || insta.span(theirs)
+			if span {
+				println("    at", describeSpan(text, span))
+			}
+			println("      chosen:     ", ruleOutline(ours, 2))
+			println("      alternative:", ruleOutline(theirs, 2))
+		}
+	}
+}
+
 func parse(preprocessed, startRule, isAmbiguity) {
 	if isAmbiguity {
 
@@ -45,6 +124,7 @@ func parse(preprocessed, startRule, isAmbiguity) {
 			parsedList[0]
 		default: {
 			print(" WARNING, ambiguity=", ambiguity)
+			explainAmbiguity(preprocessed, parsedList)
 			parsedList[0]
 		}
 		}
@@ -67,10 +147,12 @@ func Parse(path, fgo) {
 } (path, fgo, startRule) {
 	Parse(path, fgo, startRule, false, false, false)
 } (path, fgo, startRule, isNodes, isSync, isAmbiguity) {
+	Parse(path, fgo, startRule, isNodes, isSync, isAmbiguity, nil)
+} (path, fgo, startRule, isNodes, isSync, isAmbiguity, specMode) {
 	preprocessed := untabify(fgo)
 	parsed := parse(preprocessed, startRule, isAmbiguity)
 	if isNodes {
 		pprint.pprint(parsed)
 	}
-	codegen.Generate(path, parsed, isSync)
+	codegen.Generate(path, parsed, isSync, preprocessed, specMode)
 }
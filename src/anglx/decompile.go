@@ -0,0 +1,616 @@
+//////
+// This file is part of the Funcgo compiler.
+//
+// Copyright (c) 2014 Eamonn O'Brien-Strain All rights
+// reserved. This program and the accompanying materials are made
+// available under the terms of the Eclipse Public License v1.0 which
+// accompanies this distribution, and is available at
+// http://www.eclipse.org/legal/epl-v10.html
+//
+// Contributors:
+// Eamonn O'Brien-Strain e@obrain.com - initial author
+//////
+
+// A decompiler that converts Clojure source into Anglx source, using
+// the inverse of the mappings done by the code generator.  Forms that
+// have no Anglx equivalent are kept as backtick Clojure escapes.
+//
+// Public functions and vars are given capitalized names, because that
+// is how Anglx marks them public, so for example foo-bar becomes
+// FooBar (which compiles back to Foo-bar).  Public names that have no
+// plain capitalized spelling, such as foo?, are escaped with their first
+// letter capitalized, as \Foo?\.
+
+package decompile
+import (
+	"clojure/string"
+	"clojure/java/io"
+)
+import type (
+	java.io.File
+)
+
+// Clojure functions of two arguments that have an Anglx operator.
+kInfixOperators := {
+	"+": "+", "-": "-", "*": "*", "/": "/",
+	"<": "<", ">": ">", "<=": "<=", ">=": ">=",
+	"=": "==", "not=": "!=", "mod": "%",
+	"bit-and": "&", "bit-or": "|", "bit-xor": "^",
+	"bit-shift-left": "<<", "bit-shift-right": ">>",
+	"and": "&&", "or": "||"
+}
+
+// Clojure functions whose Anglx name is an operator, which can also
+// be used as a value or as the name of a function.
+kOperatorNames := dissoc(kInfixOperators, "and", "or") += {"=>": "=>", "->>": "->>"}
+
+// Words that cannot be used as plain Anglx identifiers.
+kReserved := set{
+	"are", "as", "attempt", "case", "catch", "chan", "const", "default",
+	"derive", "dosync", "dynamic", "each", "else", "ensures", "exclude",
+	"finally", "func", "given", "go", "implements", "import", "in",
+	"interface", "is", "lazy", "len", "loop", "macro", "make", "match",
+	"method", "multi", "new", "package", "range", "rebind", "requires",
+	"return", "select", "struct", "switch", "syntax", "then", "thread",
+	"times", "try", "type", "unquote", "unquotes", "var", "with", "Given"
+}
+
+// A Clojure escape of the form.  The escape ends at a backtick, so any
+// backtick in a string or character literal is written as a unicode
+// escape instead.
+func escape(form) {
+	literal := rePattern("\"(?:[^\"\\\\]|\\\\.)*\"|\\\\`")
+	text    := string.replace(prStr(form), literal, func(token String) {
+		if token == "\\`" {
+			`\u0060`
+		} else {
+			string.replace(token, "`", `\u0060`)
+		}
+	})
+	str("\\`", text, "`")
+}
+
+func escapedIdentifier(n) {
+	str(`\`, n, `\`)
+}
+
+func upcaseFirst(s String) {
+	string.upperCase(subs(s, 0, 1))  str  subs(s, 1)
+}
+
+// Convert a kebab-case Clojure name to camelCase, returning nil if the
+// result would not be a plain Anglx identifier.
+func camelcase(n String) {
+	undashed  := if n->startsWith("-") { "_"  str  subs(n, 1) } else { n }
+	converted := string.replace(undashed, /-(\p{L})/, func{string.upperCase($1[1])})
+	isPlain   := reMatches(/[\p{L}_][\p{L}\p{Nd}_]*/, converted)
+	if isPlain && !kReserved(converted) && !reFind(/^(is|mutate)\p{Lu}/, converted) {
+		converted
+	} else {
+		nil
+	}
+}
+
+// The Anglx spelling of a public top-level name, which must not start
+// with a lower-case letter.
+func publicSpelling(n String) {
+	switch {
+	case kOperatorNames(n):
+		kOperatorNames(n)
+	case camelcase(n):
+		upcaseFirst(camelcase(n))
+	default:
+		escapedIdentifier(upcaseFirst(n))
+	}
+}
+
+// The Anglx spelling of an unqualified Clojure name.
+func localName(ctx, n String) {
+	base := subs(n, 0, count(n) - 1)
+	switch {
+	case PUBLICS(ctx)(n):
+		PUBLICS(ctx)(n)
+	case n == "%" && IS_POST(ctx):
+		"result"
+	case kOperatorNames(n):
+		kOperatorNames(n)
+	case count(n) > 1 && n->endsWith("?") && camelcase(base):
+		"is"  str  upcaseFirst(camelcase(base))
+	case count(n) > 1 && n->endsWith("!") && camelcase(base):
+		"mutate"  str  upcaseFirst(camelcase(base))
+	case camelcase(n):
+		camelcase(n)
+	default:
+		escapedIdentifier(n)
+	}
+}
+
+func isClassName(n String) {
+	reFind(/^\p{Lu}/, last(string.split(n, /\./)))
+}
+
+func symbolExpr(ctx, sym) {
+	ns := namespace(sym)
+	n  := name(sym)
+	switch {
+	case isNil(ns):
+		localName(ctx, n)
+	case isClassName(ns) && camelcase(n):
+		str(ns, "::", n)
+	case !ns->contains(".") && camelcase(ns):
+		str(camelcase(ns), ".", localName({PUBLICS: {}}, n))
+	default:
+		escapedIdentifier(str(sym))
+	}
+}
+
+func labelExpr(k) {
+	n := name(k)
+	switch {
+	case namespace(k):
+		escape(k)
+	case reMatches(/[a-z][a-z0-9-]*/, n):
+		string.replace(string.upperCase(n), "-", "_")
+	case reMatches(/[a-z][a-z0-9-]*\?/, n):
+		"IS_"  str  string.replace(string.upperCase(subs(n, 0, count(n) - 1)), "-", "_")
+	default:
+		escape(k)
+	}
+}
+
+func runeExpr(c) {
+	switch c {
+	case '\n': `'\n'`
+	case '\t': `'\t'`
+	case '\r': `'\r'`
+	case '\\': `'\\'`
+	case '\'': `'\''`
+	default: str("'", c, "'")
+	}
+}
+
+func commaJoin(xs) {
+	", "  string.join  xs
+}
+
+// Convert a binding form (a parameter, or the left-hand side of a let
+// binding) to an Anglx destructuring form.
+func destructure(ctx, form) {
+	switch {
+	case isSymbol(form): {
+		tag := TAG(meta(form))
+		if tag {
+			str(localName(ctx, name(form)), " ", tag)
+		} else {
+			localName(ctx, name(form))
+		}
+	}
+	case isVector(form):
+		str("[", commaJoin(vecDestructElems(ctx, form)), "]")
+	case isMap(form) && isEvery(func{isKeyword(val($1))}, form):
+		str("{",
+			commaJoin(for [k, v] := lazy form {
+				str(destructure(ctx, k), ": ", labelExpr(v))
+			}),
+			"}")
+	default:
+		escapedIdentifier(prStr(form))
+	}
+}
+
+func vecDestructElems(ctx, form) {
+	loop(acc = [], remaining = seq(form)) {
+		[x, y] := remaining
+		switch {
+		case isEmpty(remaining):
+			acc
+		case str(x) == "&":
+			recur(acc  conj  str(destructure(ctx, y), "..."), 2  drop  remaining)
+		case x == AS:
+			recur(acc  conj  "AS"  conj  destructure(ctx, y), 2  drop  remaining)
+		default:
+			recur(acc  conj  destructure(ctx, x), rest(remaining))
+		}
+	}
+}
+
+func params(ctx, paramVector) {
+	commaJoin(vecDestructElems(ctx, paramVector))
+}
+
+func isLet(form) {
+	isSeq(form) && str(first(form)) == "let"
+}
+
+// The lines of a block of statements.  A let that is the only
+// statement becomes Given lines at the start of the block itself.
+func blockLines(ctx, forms, inner) {
+	if count(forms) == 1 && isLet(first(forms)) {
+		[_, bindings, body...] := first(forms)
+		concat(
+			for [lhs, rhs] := lazy partition(2, bindings) {
+				str(inner, "Given ", destructure(ctx, lhs), " is ", expr(ctx, rhs, inner))
+			},
+			blockLines(ctx, body, inner)
+		)
+	} else {
+		for f := lazy (if isEmpty(forms) { [nil] } else { forms }) {
+			inner  str  expr(ctx, f, inner)
+		}
+	}
+}
+
+// The statements as an Anglx block.
+func block(ctx, forms, indent) {
+	str("{\n", "\n"  string.join  blockLines(ctx, forms, indent  str  "\t"), "\n", indent, "}")
+}
+
+func returnType(paramVector) {
+	if tag := TAG(meta(paramVector)); tag {
+		str(" ", tag)
+	} else {
+		""
+	}
+}
+
+// Whether the body of a function starts with a map of conditions that
+// can be written as requires and ensures clauses.
+func hasConditions(paramVector, body) {
+	conditions := first(body)
+	count(body) > 1 && isMap(conditions) && !isEmpty(conditions)
+		&& isEvery(set{PRE, POST}, keys(conditions)) && isEvery(isVector, vals(conditions))
+		&& !some(func{$1 == symbol("result")}, flatten(seq(paramVector)))
+}
+
+// The parameter list, conditions and body of one arity of a function.
+func arityTail(ctx, [paramVector, body...], indent) {
+	conditions := if hasConditions(paramVector, body) { first(body) } else { {} }
+	clause     := func(keyword, exprs, clauseCtx) {
+		if exprs {
+			str(" ", keyword, " ", commaJoin(for e := lazy exprs { expr(clauseCtx, e, indent) }))
+		} else {
+			""
+		}
+	}
+	str("(", params(ctx, paramVector), ")", returnType(paramVector),
+		clause("requires", PRE(conditions), ctx),
+		clause("ensures", POST(conditions), ctx += {IS_POST: true}),
+		" ", block(ctx, if isEmpty(conditions) { body } else { rest(body) }, indent))
+}
+
+// The parameter lists and bodies of a function, for one or more arities.
+func functionTail(ctx, arities, indent) {
+	if isVector(first(arities)) {
+		arityTail(ctx, arities, indent)
+	} else {
+		" "  string.join  (for arity := lazy arities { arityTail(ctx, arity, indent) })
+	}
+}
+
+// Remove an optional docstring and attribute map from after the name in
+// a defn, returning the docstring as comment lines.
+func docAndArities(args) {
+	doc     := if isString(first(args)) { first(args) } else { nil }
+	afterDoc := if doc { rest(args) } else { args }
+	arities := if isMap(first(afterDoc)) { rest(afterDoc) } else { afterDoc }
+	comment := if doc {
+		str("// ", string.join("\n// ", string.splitLines(string.trim(doc))), "\n")
+	} else {
+		""
+	}
+	[comment, arities]
+}
+
+func defnExpr(ctx, [defn, sym, args...], indent) {
+	[comment, arities] := docAndArities(args)
+	isPrivate := str(defn) == "defn-" || PRIVATE(meta(sym))
+	spelling  := if isPrivate { localName(ctx, name(sym)) } else { publicSpelling(name(sym)) }
+	str(comment, "func ", spelling, functionTail(ctx, arities, indent))
+}
+
+func defExpr(ctx, form, indent) {
+	[_, sym, args...] := form
+	[comment, values] := docAndArities(args)
+	isPrivate := PRIVATE(meta(sym))
+	spelling  := if isPrivate { localName(ctx, name(sym)) } else { publicSpelling(name(sym)) }
+	if count(values) != 1 || spelling->startsWith(`\`) {
+		escape(form)
+	} else {
+		str(comment, "var ", spelling, " = ", expr(ctx, first(values), indent))
+	}
+}
+
+func fnExpr(ctx, form, indent) {
+	[_, args...] := form
+	if isSymbol(first(args)) {
+		// a named fn can recur on its name, which Anglx cannot express
+		escape(form)
+	} else {
+		"func"  str  functionTail(ctx, args, indent)
+	}
+}
+
+func letExpr(ctx, form, indent) {
+	block(ctx, [form], indent)
+}
+
+func ifExpr(ctx, [_, condition, thenForm, elseForms...], indent) {
+	str("if ", expr(ctx, condition, indent), " ", block(ctx, [thenForm], indent),
+		if isEmpty(elseForms) {
+			""
+		} else {
+			" else "  str  block(ctx, elseForms, indent)
+		})
+}
+
+func whenExpr(ctx, [_, condition, body...], indent) {
+	str("if ", expr(ctx, condition, indent), " ", block(ctx, body, indent))
+}
+
+func doExpr(ctx, [_, body...], indent) {
+	block(ctx, body, indent)
+}
+
+func condExpr(ctx, [_, clauses...], indent) {
+	inner := indent  str  "\t"
+	cases := for [test, result] := lazy partition(2, clauses) {
+		if test == ELSE || test == true {
+			str(inner, "default: ", expr(ctx, result, inner))
+		} else {
+			str(inner, "case ", expr(ctx, test, inner), ": ", expr(ctx, result, inner))
+		}
+	}
+	str("switch {\n", "\n"  string.join  cases, "\n", indent, "}")
+}
+
+func caseExpr(ctx, [_, x, clauses...], indent) {
+	inner := indent  str  "\t"
+	cases := for [constant, result] := lazy partition(2, clauses) {
+		constants := if isSeq(constant) { constant } else { [constant] }
+		str(inner, "case ", commaJoin(for c := lazy constants { expr(ctx, c, inner) }),
+			": ", expr(ctx, result, inner))
+	}
+	defaults := if isOdd(count(clauses)) {
+		[str(inner, "default: ", expr(ctx, last(clauses), inner))]
+	} else {
+		[]
+	}
+	str("switch ", expr(ctx, x, indent), " {\n",
+		"\n"  string.join  concat(cases, defaults), "\n", indent, "}")
+}
+
+// The clauses that follow the first binding of a doseq or for.
+func eachClauses(ctx, pairs, keyword, indent) {
+	for [k, v] := lazy pairs {
+		switch k {
+		case WHEN:  str(" if ", expr(ctx, v, indent))
+		case WHILE: str(" while ", expr(ctx, v, indent))
+		case LET:
+			string.join(for [lhs, rhs] := lazy partition(2, v) {
+				str(" where ", destructure(ctx, lhs), " is ", expr(ctx, rhs, indent))
+			})
+		default:
+			str(", ", destructure(ctx, k), " in ", keyword, " ", expr(ctx, v, indent))
+		}
+	}
+}
+
+func eachExpr(ctx, form, indent) {
+	[loopKind, bindings, body...] := form
+	[x, coll] := bindings
+	keyword := switch str(loopKind) {
+	case "doseq": "range"
+	case "for": "lazy"
+	default: "times"
+	}
+	switch {
+	case count(bindings) == 2:
+		str("each ", destructure(ctx, x), " in ", keyword, " ", expr(ctx, coll, indent), " ",
+			block(ctx, body, indent))
+	case keyword != "times" && isEven(count(bindings)) && !isKeyword(x):
+		str("each ", destructure(ctx, x), " in ", keyword, " ", expr(ctx, coll, indent),
+			string.join(eachClauses(ctx, rest(partition(2, bindings)), keyword, indent)), " ",
+			block(ctx, body, indent))
+	default:
+		escape(form)
+	}
+}
+
+func loopExpr(ctx, [_, bindings, body...], indent) {
+	consts := for [lhs, rhs] := lazy partition(2, bindings) {
+		str(destructure(ctx, lhs), " = ", expr(ctx, rhs, indent))
+	}
+	str("loop(", commaJoin(consts), ") ", block(ctx, body, indent))
+}
+
+func tryExpr(ctx, [_, forms...], indent) {
+	clauseName := func{ if isSeq($1) { str(first($1)) } else { nil } }
+	body       := remove(func{ set{"catch", "finally"}(clauseName($1)) }, forms)
+	catches    := filter(func{ clauseName($1) == "catch" }, forms)
+	finallys   := filter(func{ clauseName($1) == "finally" }, forms)
+	str("try ", block(ctx, body, indent),
+		apply(str, for [_, typ, e, handler...] := lazy catches {
+			str(" catch ", typ, " ", localName(ctx, name(e)), " ", block(ctx, handler, indent))
+		}),
+		apply(str, for [_, cleanup...] := lazy finallys {
+			" finally "  str  block(ctx, cleanup, indent)
+		}))
+}
+
+func callExpr(ctx, head, args, indent) {
+	str(head, "(", commaJoin(for a := lazy args { expr(ctx, a, indent) }), ")")
+}
+
+func infixExpr(ctx, operator, args, indent) {
+	str("(",
+		str(" ", operator, " ")  string.join  (for a := lazy args { expr(ctx, a, indent) }),
+		")")
+}
+
+// Special forms and macros that have their own Anglx syntax.
+kSpecialForms := {
+	"defn": defnExpr, "defn-": defnExpr, "def": defExpr, "fn": fnExpr,
+	"let": letExpr, "if": ifExpr, "when": whenExpr, "do": doExpr,
+	"cond": condExpr, "case": caseExpr, "doseq": eachExpr, "for": eachExpr,
+	"dotimes": eachExpr, "loop": loopExpr, "try": tryExpr
+}
+
+func listExpr(ctx, form, indent) {
+	[head, args...] := form
+	op := if isSymbol(head) && isNil(namespace(head)) { name(head) } else { nil }
+	switch {
+	case isEmpty(form):
+		"list()"
+	case kSpecialForms(op):
+		kSpecialForms(op)(ctx, form, indent)
+	case op == "quote" || op == "fn*" || op == "var":
+		escape(form)
+	case str(head) == "clojure.core/deref":
+		"*"  str  expr(ctx, first(args), indent)
+	case op == "not" && count(args) == 1:
+		"!"  str  expr(ctx, first(args), indent)
+	case op == "-" && count(args) == 1:
+		"-"  str  expr(ctx, first(args), indent)
+	case kInfixOperators(op) && (count(args) == 2 || (count(args) > 2 && (op == "and" || op == "or"))):
+		infixExpr(ctx, kInfixOperators(op), args, indent)
+	case op == "new":
+		callExpr(ctx, str("new ", first(args)), rest(args), indent)
+	case op && count(op) > 1 && op->endsWith(".") && isClassName(op):
+		callExpr(ctx, str("new ", subs(op, 0, count(op) - 1)), args, indent)
+	case op && count(op) > 1 && op->startsWith(".-"):
+		str(expr(ctx, first(args), indent), "->_", subs(op, 2))
+	case op && count(op) > 1 && op->startsWith("."):
+		callExpr(ctx, str(expr(ctx, first(args), indent), "->", subs(op, 1)), rest(args), indent)
+	default:
+		callExpr(ctx, expr(ctx, head, indent), args, indent)
+	}
+}
+
+// A string literal, with ${ escaped so that it is not interpolated.
+func stringExpr(form String) {
+	string.replace(prStr(form), "${", `\${`)
+}
+
+// Convert a Clojure form to an Anglx expression, with any continuation
+// lines indented by the given indent.
+func expr(ctx, form, indent) {
+	switch {
+	case isNil(form):      "nil"
+	case isString(form):   stringExpr(form)
+	case isChar(form):     runeExpr(form)
+	case isNumber(form):   if isRatio(form) { escape(form) } else { prStr(form) }
+	case isKeyword(form):  labelExpr(form)
+	case isSymbol(form):   symbolExpr(ctx, form)
+	case isVector(form):   str("[", commaJoin(for x := lazy form { expr(ctx, x, indent) }), "]")
+	case isMap(form):      str("{", commaJoin(for [k, v] := lazy form {
+		str(expr(ctx, k, indent), ": ", expr(ctx, v, indent))
+	}), "}")
+	case isSet(form):      str("set{", commaJoin(for x := lazy form { expr(ctx, x, indent) }), "}")
+	case isSeq(form):      listExpr(ctx, form, indent)
+	case form == true || form == false: str(form)
+	default:               escape(form)
+	}
+}
+
+func requireDecl(ctx, specs) {
+	lines := for spec := lazy specs {
+		[ns, options...] := if isVector(spec) { spec } else { [spec] }
+		opts    := apply(hashMap, options)
+		path    := prStr(string.replace(str(ns), ".", "/"))
+		alias   := AS(opts)
+		refers  := if REFER(opts) {
+			str("\t// TODO(decompile) :refer ", prStr(REFER(opts)), " from ", ns,
+				" is not supported, so qualify those uses\n")
+		} else {
+			""
+		}
+		if alias {
+			str(refers, "\t", localName({PUBLICS: {}}, name(alias)), " ", path)
+		} else {
+			str(refers, "\t", path)
+		}
+	}
+	str("import (\n", "\n"  string.join  lines, "\n)")
+}
+
+func typeImportDecl(specs) {
+	lines := for spec := lazy specs {
+		if isSymbol(spec) {
+			"\t"  str  spec
+		} else {
+			[pkg, classes...] := spec
+			str("\t", pkg, ".{", commaJoin(classes), "}")
+		}
+	}
+	str("import type (\n", "\n"  string.join  lines, "\n)")
+}
+
+func excludeDecls(specs) {
+	for [option, symbols] := lazy partition(2, specs) if option == EXCLUDE {
+		str("exclude ( ", commaJoin(for s := lazy symbols { localName({PUBLICS: {}}, name(s)) }), " )")
+	}
+}
+
+// The :require, :import and :refer-clojure clauses of an ns form, as
+// Anglx import declarations in the same order.
+func importDecls(ctx, clauses) {
+	mapcat(func(c) {
+		[kind, specs...] := c
+		switch kind {
+		case GEN_CLASS:     []
+		case REQUIRE:       [requireDecl(ctx, specs)]
+		case IMPORT:        [typeImportDecl(specs)]
+		case REFER_CLOJURE: excludeDecls(specs)
+		default:            ["// TODO(decompile) unsupported ns clause "  str  prStr(c)]
+		}
+	}, isSeq  filter  clauses)
+}
+
+// Return a map from each public name defined at top level to its Anglx
+// spelling, so that references to it can be renamed consistently.
+func publicNames(forms) {
+	into({}, for f := lazy forms if isSeq(f) && set{"defn", "def"}(str(first(f))) && isSymbol(second(f)) && !PRIVATE(meta(second(f))) {
+		[name(second(f)), publicSpelling(name(second(f)))]
+	})
+}
+
+// The compiler adds this after the ns form of a .clj file.
+kWarnOnReflection := readString("(set! *warn-on-reflection* true)")
+
+// Return Anglx source equivalent to the Clojure source text.  The
+// package name comes from the path, the way the compiler expects it.
+func Decompile(path String, cljText) {
+	forms   := readString(str("[", cljText, "]"))
+	ctx     := {PUBLICS: publicNames(forms)}
+	pkg     := string.replace(last(string.split(path, /[\/\\]/)), /\.cljs?$/, "")
+	hasNs   := isSeq(first(forms)) && str(first(first(forms))) == "ns"
+	[comment, clauses] := docAndArities(if hasNs { 2  drop  first(forms) } else { [] })
+	header  := concat([str(comment, "package ", pkg)], importDecls(ctx, clauses))
+	afterNs := if hasNs { rest(forms) } else { forms }
+	others  := if first(afterNs) == kWarnOnReflection { rest(afterNs) } else { afterNs }
+	body    := for f := lazy others { expr(ctx, f, "") }
+	str("\n\n"  string.join  concat(["\n"  string.join  header], body), "\n")
+}
+
+// Write the Anglx version of a .clj or .cljs file next to it, as a
+// .anx or .anxs file respectively.
+func DecompileFile(inFile File) {
+	inPath  := inFile->getPath()
+	outFile := io.file(string.replace(inPath, /\.clj(s?)$/, ".anx$1"))
+	println("  ", inPath, "...")
+	anx     := Decompile(inPath, slurp(inFile))
+	spit(outFile, anx)
+	todos   := count(reSeq(/TODO\(decompile\)/, anx))
+	println("\t\t-->", outFile->getPath(),
+		if todos == 0 { "" } else { str("(", todos, " TODOs)") })
+}
+
+// Decompile every Clojure file in the given file or directory tree.
+func DecompileTree(root File) {
+	for f := range fileSeq(root) {
+		file File := f
+		if reFind(/\.cljs?$/, file->getName()) {
+			DecompileFile(file)
+		}
+	}
+}
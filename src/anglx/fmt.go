@@ -0,0 +1,359 @@
+//////
+// This file is part of the Funcgo compiler.
+//
+// Copyright (c) 2014 Eamonn O'Brien-Strain All rights
+// reserved. This program and the accompanying materials are made
+// available under the terms of the Eclipse Public License v1.0 which
+// accompanies this distribution, and is available at
+// http://www.eclipse.org/legal/epl-v10.html
+//
+// Contributors:
+// Eamonn O'Brien-Strain e@obrain.com - initial author
+//////
+
+// The anglxfmt tool, which prints Anglx source in a canonical layout:
+// one tab of indentation for each line with an unclosed bracket, case
+// clauses level with their switch, sorted imports, aligned Given
+// declarations, exactly two spaces around infix function calls, no
+// trailing whitespace and no runs of blank lines.  Only whitespace
+// outside literals and comments is changed, and the result is checked
+// to parse to the same tree.
+
+package fmt
+import (
+	insta "instaparse/core"
+	"instaparse/failure"
+	"clojure/java/io"
+	"clojure/string"
+	"clojure/tools/cli"
+	"clojure/walk"
+	"anglx/parser"
+)
+import type (
+	java.io.{File, IOException}
+)
+
+commandLineOptions := [
+	["-w", "--write", "write the result back to the source file instead of printing it"],
+	["-c", "--check", "list the files that are not formatted, and fail if there are any"],
+	["-h", "--help",  "print help"]
+]
+
+// Return the scanned text for the character at position i in the given
+// state, the number of characters scanned, and the state after them.
+func scan(text String, i, c, next, state) {
+	isEscape := c == '\\' && next && next != '\n'
+	switch state {
+	case CODE:
+		switch {
+		case c == '"' || c == '“' || c == '”':
+			[str(c), 1, STRING]
+		case c == '`':
+			[str(c), 1, RAW]
+		case c == '/' && next == '/':
+			["xx", 2, COMMENT]
+		case c == '/' && next == '*' && isBlockCommentStart(text, i):
+			["xx", 2, BLOCK_COMMENT]
+		case c == '\'':
+			[str(c), 1, RUNE]
+		case c == '/' && isRegexStart(text, i, next):
+			[str(c), 1, REGEX]
+		default:
+			[str(c), 1, CODE]
+		}
+	case COMMENT:
+		["x", 1, COMMENT]
+	case BLOCK_COMMENT:
+		if c == '*' && next == '/' { ["xx", 2, CODE] } else { ["x", 1, BLOCK_COMMENT] }
+	case RAW:
+		if c == '`' { [str(c), 1, CODE] } else { ["x", 1, RAW] }
+	case STRING:
+		switch {
+		case isEscape:                          ["xx", 2, STRING]
+		case c == '"' || c == '“' || c == '”': [str(c), 1, CODE]
+		default:                                ["x", 1, STRING]
+		}
+	case REGEX:
+		switch {
+		case isEscape: ["xx", 2, REGEX]
+		case c == '/': [str(c), 1, CODE]
+		default:       ["x", 1, REGEX]
+		}
+	default: // RUNE
+		switch {
+		case isEscape:  ["xx", 2, RUNE]
+		case c == '\'': [str(c), 1, CODE]
+		default:        ["x", 1, RUNE]
+		}
+	}
+}
+
+// A slash starts a regular expression unless it looks like division,
+// that is unless it follows an operand or is followed by a space.
+func isRegexStart(text String, i, next) {
+	prev := if i > 0 { text->charAt(i - 1) } else { ' ' }
+	isOperandEnd := Character::isLetterOrDigit(char(prev)) || prev == '_' || prev == ')' || prev == ']'
+	next && !isOperandEnd && !set{' ', '\t', '\n', '/', '='}(next)
+}
+
+// A block comment starts at the beginning of the text or after
+// whitespace, so that a slash followed by an asterisk can be division.
+func isBlockCommentStart(text String, i) {
+	i == 0 || Character::isWhitespace(text->charAt(i - 1))
+}
+
+// Return the text with the contents of every string, rune, regular
+// expression and comment replaced by x characters, together with the
+// set of (zero-based) numbers of the lines that start inside a
+// literal.  Brackets and keywords can then be found in the masked text
+// without being fooled by literals.
+func Mask(text String) {
+	n  := count(text)
+	sb := new StringBuilder()
+	loop(i = 0, state = CODE, line = 0, literalLines = set{}) {
+		if i >= n {
+			[sb->toString(), literalLines]
+		} else {
+			c    := text->charAt(i)
+			next := if i + 1 < n { text->charAt(i + 1) } else { nil }
+			if c == '\n' {
+				sb->append(c)
+				nextState := if state == RAW || state == STRING || state == BLOCK_COMMENT { state } else { CODE }
+				recur(i + 1, nextState, line + 1,
+					if nextState == CODE { literalLines } else { literalLines  conj  (line + 1) })
+			} else {
+				[scanned, width, nextState] := scan(text, i, c, next, state)
+				sb->append(scanned)
+				recur(i + width, nextState, line, literalLines)
+			}
+		}
+	}
+}
+
+func parse(text String) {
+	parsed := parser.Parse(text)
+	if insta.isFailure(parsed) {
+		nonpkg := parser.Parse(text, START, NONPKGFILE)
+		if insta.isFailure(nonpkg) {
+			throw(new IOException(str(withOutStr(failure.pprintFailure(parsed)))))
+		} else {
+			nonpkg
+		}
+	} else {
+		parsed
+	}
+}
+
+// The edit that replaces the spaces starting at pos by exactly two,
+// or nil if they are already two or are followed by a line break.
+func gapEdit(text String, pos) {
+	gap   := reFind(/^[ \t]*/, subs(text, pos))
+	after := pos + count(gap)
+	if gap != "  " && after < count(text) && text->charAt(after) != '\n' {
+		[pos, after, "  "]
+	} else {
+		nil
+	}
+}
+
+// The edits that put exactly two spaces on each side of the function
+// name of every infix call, such as a  max  b.
+func infixEdits(text String, tree) {
+	infixCalls := for node := lazy treeSeq(isVector, rest, tree) if first(node) == PRECEDENCE0 && count(node) == 4 {
+		node
+	}
+	remove(isNil, mapcat(func([_, left, symbol, _]) {
+		[gapEdit(text, second(insta.span(left))), gapEdit(text, second(insta.span(symbol)))]
+	}, infixCalls))
+}
+
+func applyEdits(text String, edits) {
+	reduce(func(acc String, [start, end, replacement]) {
+		str(subs(acc, 0, start), replacement, subs(acc, end))
+	}, text, reverse(sortBy(first, edits)))
+}
+
+func isCaseClause(trimmed String) {
+	reFind(/^(case\b|default\s*:)/, trimmed)
+}
+
+// Re-indent the lines with one tab for each earlier line that has a
+// bracket still open, with case clauses level with their switch.  Lines
+// starting inside a literal are left alone.
+func reindent(lines, maskLines, literalLines) {
+	loop(out = [], stack = (), i = 0) {
+		if i == count(lines) {
+			out
+		} else {
+			line    String := lines[i]
+			code    String := maskLines[i]
+			closers := count(reFind(/^[\)\]\}]*/, string.triml(code)))
+			opened  := drop(closers, stack)
+			level   := count(distinct(opened))
+			trimmed := string.triml(line)
+			indent  := if isCaseClause(trimmed) { max(0, level - 1) } else { level }
+			leading := count(line) - count(trimmed)
+			after   := reduce(func(s, bracket) {
+				if set{'(', '[', '{'}(bracket) {
+					i  cons  s
+				} else {
+					rest(s)
+				}
+			}, opened, filter(set{'(', '[', '{', ')', ']', '}'}, subs(code, min(count(code), leading + closers))))
+			indented := switch {
+			case literalLines(i): line
+			case trimmed == "":   ""
+			default:              str(string.join(repeat(indent, "\t")), trimmed)
+			}
+			recur(out  conj  (if literalLines(i + 1) { indented } else { string.trimr(indented) }),
+				after, i + 1)
+		}
+	}
+}
+
+// Pad the names in each run of Given declarations at the same
+// indentation so that their is keywords line up.
+func alignGivens(lines, literalLines) {
+	givenRe := /^(\t*)Given (\S+) +is (.*)$/
+	isGiven := func(i) { !literalLines(i) && reFind(givenRe, lines[i]) }
+	runs    := partitionBy(func{ if isGiven($1) { second(reFind(givenRe, lines[$1])) } else { $1 } },
+		\`range`(count(lines)))
+	vec(mapcat(func(run) {
+		if isGiven(first(run)) {
+			width := reduce(max, for i := lazy run { count(reFind(givenRe, lines[i])[2]) })
+			for i := lazy run {
+				[_, indent, name, value] := reFind(givenRe, lines[i])
+				str(indent, "Given ", name, string.join(repeat(width - count(name), " ")), " is ", value)
+			}
+		} else {
+			for i := lazy run { lines[i] }
+		}
+	}, runs))
+}
+
+func importKey(line String) {
+	last(reSeq(/"[^"]*"/, line)) || string.trim(line)
+}
+
+// Sort the specs inside each parenthesized import declaration, unless
+// the declaration has comments that might be about particular specs.
+func sortImports(lines) {
+	loop(out = [], remaining = lines) {
+		[line, more...] := remaining
+		if isEmpty(remaining) {
+			out
+		} else {
+			if reMatches(/\t*import( type| macros| extern)? \(/, line) {
+				specs := func{string.trim($1) != ")"}  takeWhile  more
+				rem   := drop(count(specs), more)
+				if isEmpty(rem) || some(func{ $1->contains("//") || string.isBlank($1) }, specs) {
+					recur(out  conj  line, more)
+				} else {
+					recur(into(out  conj  line, importKey  sortBy  specs), rem)
+				}
+			} else {
+				recur(out  conj  line, more)
+			}
+		}
+	}
+}
+
+// Drop blank lines at the start, and blank lines that follow another
+// blank line, except inside literals.
+func collapseBlankLines(lines, literalLines) {
+	isBlankCode := func(i) {
+		i < 0 || (lines[i] == "" && !literalLines(i))
+	}
+	for i := lazy \`range`(count(lines)) if !(isBlankCode(i) && isBlankCode(i - 1)) {
+		lines[i]
+	}
+}
+
+// Make the parse tree independent of the order of imports.
+func normalized(tree) {
+	walk.postwalk(func(node) {
+		if isVector(node) && set{IMPORTDECL, MACROIMPORTDECL, TYPEIMPORTDECL}(first(node)) {
+			vec(first(node)  cons  (prStr  sortBy  rest(node)))
+		} else {
+			node
+		}
+	}, tree)
+}
+
+func formatOnce(text String) {
+	tree                   := parse(text)
+	spaced                 := applyEdits(text, infixEdits(text, tree))
+	[masked, literalLines] := Mask(spaced)
+	lines                  := reindent(
+		string.split(spaced, /\n/, -1),
+		string.split(masked, /\n/, -1),
+		literalLines
+	)
+	aligned   := sortImports(alignGivens(lines, literalLines))
+	formatted := string.trim("\n"  string.join  collapseBlankLines(aligned, literalLines))  str  "\n"
+	if normalized(parse(formatted)) != normalized(tree) {
+		throw(new IOException("Formatting would change the parse tree, so the source was left alone."))
+	}
+	formatted
+}
+
+// Return the Anglx source text in canonical layout.  Throws an
+// IOException if the text does not parse.
+func Format(text String) {
+	formatted := formatOnce(text)
+	if formatOnce(formatted) != formatted {
+		throw(new IOException("Formatting is not stable, so the source was left alone."))
+	}
+	formatted
+}
+
+func isSourceFile(f File) {
+	reFind(/\.anxs?$/, f->getName())
+}
+
+// Format one file as the options direct.  Return true if it could not
+// be formatted or, when checking, if it was not already formatted.
+func formatFile(file File, opts) {
+	try {
+		text      := slurp(file)
+		formatted := Format(text)
+		isChanged := formatted != text
+		if opts(CHECK) {
+			if isChanged {
+				println(file->getPath())
+			}
+		} else {
+			if opts(WRITE) {
+				if isChanged {
+					spit(file, formatted)
+				}
+			} else {
+				print(formatted)
+			}
+		}
+		opts(CHECK) && isChanged
+	} catch IOException e {
+		println(file->getPath(), "\n", e->getMessage())
+		true
+	}
+}
+
+// Entry point for the formatter.  The arguments are options followed
+// by Anglx files or directories containing them.
+func _main(args...) {
+	cmdLine := args  cli.parseOpts  commandLineOptions
+	opts    := cmdLine(OPTIONS)
+	paths   := cmdLine(ARGUMENTS)
+	if cmdLine(ERRORS) || opts(HELP) || isEmpty(paths) {
+		println(cmdLine(ERRORS))
+		println("USAGE:  anglxfmt [options] path ...")
+		println("options:")
+		println(cmdLine(SUMMARY))
+	} else {
+		files    := isSourceFile  filter  mapcat(func{fileSeq(io.file($1))}, paths)
+		failures := count(func{formatFile($1, opts)}  filter  files)
+		if failures > 0 {
+			System::exit(1)
+		}
+	}
+}
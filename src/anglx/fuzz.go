@@ -0,0 +1,321 @@
+//////
+// This file is part of the Funcgo compiler.
+//
+// Copyright (c) 2014 Eamonn O'Brien-Strain All rights
+// reserved. This program and the accompanying materials are made
+// available under the terms of the Eclipse Public License v1.0 which
+// accompanies this distribution, and is available at
+// http://www.eclipse.org/legal/epl-v10.html
+//
+// Contributors:
+// Eamonn O'Brien-Strain e@obrain.com - initial author
+//////
+
+// A fuzzer that generates random programs from the grammar of the
+// parser and checks that the compiler either rejects them with an
+// IOException or generates Clojure that can be read back.  Failing
+// programs are shrunk to a small reproducer.
+
+package fuzz
+import (
+	insta "instaparse/core"
+	"anglx/parser"
+	"anglx/core"
+)
+import type (
+	java.io.IOException
+	java.util.{ArrayList, Collections, Random}
+)
+
+// Stands in for the cost of a rule that cannot be generated at all.
+kInfinity := 1000000
+
+// Candidate text for the regular-expression terminals of the grammar.
+// For each terminal the fuzzer picks among the candidates that it
+// matches.
+kTokens := [
+	"a", "b", "foo", "barBaz", "x1", "_x", "A", "Foo", "String",
+	"FOO", "BAR_BAZ", "0", "1", "7", "42", "017", "ff", "1.5", ".5",
+	"2e10", "M", "N", `"hello"`, `"a\"b"`, "/a+b/", "abc", "`",
+	`\range\`, "\n", ";", "// note\n", "  ", " "
+]
+
+// Return the text that a regular-expression terminal can generate.  A
+// keyword such as #'\bpackage\b' generates exactly itself.
+func candidates(re) {
+	word := str(re)->replace(`\b`, "")
+	if reMatches(/\p{L}+/, word) {
+		[word]
+	} else {
+		vec(func{reMatches(re, $1)}  filter  kTokens)
+	}
+}
+
+// The minimum nesting of nonterminals needed to generate text for the
+// combinator, given the current estimates for the nonterminals.
+func cost(costs, p) {
+	switch TAG(p) {
+	case NT:
+		min(kInfinity, 1 + costs(KEYWORD(p), kInfinity))
+	case CAT:
+		reduce(max, 0, for q := lazy PARSERS(p) { cost(costs, q) })
+	case ALT:
+		reduce(min, kInfinity, for q := lazy PARSERS(p) { cost(costs, q) })
+	case ORD:
+		min(cost(costs, PARSER1(p)), cost(costs, PARSER2(p)))
+	case PLUS:
+		cost(costs, PARSER(p))
+	case REP:
+		if MIN(p) == 0 { 0 } else { cost(costs, PARSER(p)) }
+	case REGEXP:
+		if isEmpty(candidates(REGEXP(p))) { kInfinity } else { 0 }
+	default:
+		0
+	}
+}
+
+// Return the cost of every nonterminal of the grammar, iterating until
+// the estimates no longer change.
+func nonterminalCosts(grammar) {
+	loop(costs = {}) {
+		updated := into({}, for [k, p] := lazy grammar { [k, cost(costs, p)] })
+		if updated == costs {
+			costs
+		} else {
+			recur(updated)
+		}
+	}
+}
+
+// Return a fuzzing context for the parser's grammar, whose random
+// choices are determined by the seed.
+func NewContext(seed) {
+	grammar := GRAMMAR(parser.Parse)
+	{
+		GRAMMAR:   grammar,
+		COSTS:     nonterminalCosts(grammar),
+		RANDOM:    new Random(seed),
+		MAX_DEPTH: 40,
+		START:     NONPKGFILE
+	}
+}
+
+func randomInt(ctx, n) {
+	random Random := RANDOM(ctx)
+	random->nextInt(n)
+}
+
+func shuffled(ctx, xs) {
+	list := new ArrayList(xs)
+	Collections::shuffle(list, RANDOM(ctx))
+	vec(list)
+}
+
+// Return the tokens generated for one of the alternatives, or nil if
+// none of them can be generated.  Once past the maximum depth only the
+// cheapest alternatives are tried, so that generation terminates.
+func generateOneOf(ctx, alternatives, depth) {
+	ordered := if depth < MAX_DEPTH(ctx) {
+		shuffled(ctx, alternatives)
+	} else {
+		func{cost(COSTS(ctx), $1)}  sortBy  alternatives
+	}
+	loop(remaining = ordered) {
+		if isEmpty(remaining) {
+			nil
+		} else {
+			if tokens := generate(ctx, first(remaining), depth); tokens {
+				tokens
+			} else {
+				recur(rest(remaining))
+			}
+		}
+	}
+}
+
+// Return the tokens generated by repeating the combinator at least the
+// given number of times, or nil if it cannot be generated.
+func generateRepeated(ctx, p, depth, minimum) {
+	n := if depth < MAX_DEPTH(ctx) { minimum + randomInt(ctx, 3) } else { minimum }
+	loop(acc = [], i = 0) {
+		if i == n {
+			acc
+		} else {
+			if tokens := generate(ctx, p, depth); tokens {
+				recur(acc  into  tokens, i + 1)
+			} else {
+				nil
+			}
+		}
+	}
+}
+
+// Return a random vector of tokens matching the combinator, or nil if
+// it cannot be generated.  Lookaheads generate nothing, and whitespace
+// is added when the tokens are joined.
+func generate(ctx, p, depth) {
+	switch TAG(p) {
+	case NT:
+		if KEYWORD(p) == WS_OR_COMMENTS {
+			[]
+		} else {
+			generate(ctx, GRAMMAR(ctx)(KEYWORD(p)), depth + 1)
+		}
+	case CAT:
+		loop(acc = [], ps = PARSERS(p)) {
+			if isEmpty(ps) {
+				acc
+			} else {
+				if tokens := generate(ctx, first(ps), depth); tokens {
+					recur(acc  into  tokens, rest(ps))
+				} else {
+					nil
+				}
+			}
+		}
+	case ALT:
+		generateOneOf(ctx, PARSERS(p), depth)
+	case ORD:
+		generateOneOf(ctx, [PARSER1(p), PARSER2(p)], depth)
+	case OPT:
+		if depth < MAX_DEPTH(ctx) && randomInt(ctx, 2) == 0 {
+			generate(ctx, PARSER(p), depth) || []
+		} else {
+			[]
+		}
+	case STAR:
+		generateRepeated(ctx, PARSER(p), depth, 0)
+	case PLUS:
+		generateRepeated(ctx, PARSER(p), depth, 1)
+	case REP:
+		generateRepeated(ctx, PARSER(p), depth, MIN(p))
+	case STRING, STRING_CI:
+		[STRING(p)]
+	case REGEXP: {
+		texts := candidates(REGEXP(p))
+		if isEmpty(texts) {
+			nil
+		} else {
+			[texts[randomInt(ctx, count(texts))]]
+		}
+	}
+	default:
+		[]
+	}
+}
+
+// Concatenate the tokens, separating them by a space only where two
+// word characters would otherwise run together.
+func joinTokens(tokens) {
+	reduce(func(acc String, token String) {
+		if reFind(/[\p{L}\p{Nd}_]$/, acc) && reFind(/^[\p{L}\p{Nd}_]/, token) {
+			str(acc, " ", token)
+		} else {
+			acc  str  token
+		}
+	}, "", tokens)
+}
+
+// Return a random program that the parser accepts, or nil if none was
+// found in a hundred attempts.
+func RandomProgram(ctx) {
+	loop(tries = 0) {
+		if tries < 100 {
+			tokens  := generate(ctx, {TAG: NT, KEYWORD: START(ctx)}, 0)
+			program := joinTokens(tokens)
+			if tokens && !insta.isFailure(parser.Parse(program, START, START(ctx))) {
+				program
+			} else {
+				recur(tries + 1)
+			}
+		} else {
+			nil
+		}
+	}
+}
+
+// Whether the exception is the compiler rejecting the program.  The
+// compiler rejects programs with an IOException, which Clojure may wrap
+// on its way out of a lazy sequence or a reflective call.
+func IsRejection(e) {
+	causes := takeWhile(identity, iterate(func(t Throwable) { t->getCause() }, e))
+	some(func{isInstance(IOException, $1)}, causes)  ||  false
+}
+
+// Compile the program, returning nil if the compiler either accepted
+// or rejected it, otherwise returning the kind of failure and its
+// message.
+func Check(program) {
+	try {
+		clj := core.Parse("fuzz.anx", program, NONPKGFILE)
+		try {
+			readString(str("[", clj, "]"))
+			nil
+		} catch Exception e {
+			{
+				KIND:    str("unreadable Clojure (", e->getClass()->getName(), ")"),
+				MESSAGE: str(e->getMessage(), "\n", clj)
+			}
+		}
+	} catch Exception e {
+		if IsRejection(e) {
+			nil
+		} else {
+			{
+				KIND:    str("compiler crashed (", e->getClass()->getName(), ")"),
+				MESSAGE: e->getMessage()
+			}
+		}
+	}
+}
+
+// Return the smallest text, found by repeatedly deleting ever smaller
+// chunks of the program, for which isFailing is still true.
+func Shrink(program String, isFailing) {
+	loop(current String = program, chunk = quot(count(program), 2)) {
+		if chunk == 0 {
+			current
+		} else {
+			smaller := for start := lazy \`range`(0, count(current), chunk) {
+				str(
+					subs(current, 0, start),
+					subs(current, min(count(current), start + chunk))
+				)
+			}
+			if shrunk := first(isFailing  filter  smaller); shrunk {
+				recur(shrunk, min(chunk, quot(count(shrunk), 2)))
+			} else {
+				recur(current, quot(chunk, 2))
+			}
+		}
+	}
+}
+
+// Generate and check n random programs, printing a shrunk reproducer
+// for each failure.  Return the number of failures.
+func Run(n, seed) {
+	println("Fuzzing with seed", seed)
+	ctx := NewContext(seed)
+	reduce(func(failures, i) {
+		program := RandomProgram(ctx)
+		failure := program && Check(program)
+		if failure {
+			isSameFailure := func(candidate) {
+				if f := Check(candidate); f {
+					KIND(f) == KIND(failure)
+				} else {
+					false
+				}
+			}
+			shrunk := Shrink(program, isSameFailure)
+			println()
+			println("FAILURE", i, KIND(failure))
+			println(MESSAGE(failure))
+			println("  program, shrunk from", count(program), "to", count(shrunk), "characters:")
+			println(shrunk)
+			failures + 1
+		} else {
+			failures
+		}
+	}, 0, \`range`(n))
+}
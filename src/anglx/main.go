@@ -21,6 +21,8 @@ import (
         "clojure/string"
         "clojure/tools/cli"
         "anglx/core"
+        "anglx/decompile"
+        "anglx/fuzz"
 )
 import type (
 	java.io.{BufferedWriter, File, StringWriter, IOException}
@@ -33,7 +35,13 @@ commandLineOptions := [
         ["-n", "--nodes", "print out the parse tree that the parser produces"],
         ["-u", "--ugly",  "do not pretty-print the Clojure"],
         ["-f", "--force", "Force compiling even if not out-of-date"],
-        ["-a", "--ambiguity",  "print out all matched parse trees to diagnose ambiguity"],
+        ["-a", "--ambiguity",  "show where and how the parse is ambiguous"],
+        ["-d", "--decompile", "convert Clojure files to Anglx instead of compiling"],
+        [nil, "--spec", "generate clojure.spec definitions from struct and func types"],
+        [nil, "--validate", "like --spec, and also instrument public functions"],
+        ["-z", "--fuzz COUNT", "compile COUNT random programs, reporting any that crash the compiler",
+         PARSE_FN, func{Integer::parseInt($1)}],
+        [nil, "--seed SEED", "random seed for --fuzz", PARSE_FN, func{Long::parseLong($1)}],
         ["-h", "--help",  "print help"]
 ]
 
@@ -49,8 +57,8 @@ func prettyPrint(obj, writer) {
 					if met(TAG) {
 						origDispatch(met(TAG))
 					} else {
-						if met(PRIVATE) == true {
-							origDispatch(PRIVATE)
+						if val(first(met)) == true {
+							origDispatch(key(first(met)))
 						} else {
 							origDispatch(met)
 						}
@@ -110,8 +118,18 @@ func repl(){
 	}
 }
 
+// Which clojure.spec definitions, if any, the options ask for.
+func specMode(opts) {
+	switch {
+	case opts(VALIDATE): VALIDATE
+	case opts(SPEC):     SPEC
+	}
+}
+
 func CompileString(inPath, fgoText) {
-	cljText   := core.Parse(inPath, fgoText)
+	CompileString(inPath, fgoText, nil)
+} (inPath, fgoText, specMode) {
+	cljText   := core.Parse(inPath, fgoText, SOURCEFILE, false, false, false, specMode)
 	strWriter := new StringWriter()
 	writer    := new BufferedWriter(strWriter)
 	cljText  writePrettyTo  writer
@@ -146,7 +164,8 @@ func compileFile(inFile File, root File, opts) {
 					relative,
 					fgoText,
 					start,
-					opts(NODES), opts(SYNC), opts(AMBIGUITY)
+					opts(NODES), opts(SYNC), opts(AMBIGUITY),
+					specMode(opts)
 				)
 				duration := System::currentTimeMillis() - beginTime
 				// TODO(eob) open using with-open
@@ -216,19 +235,32 @@ func Compile(args...) {
 	if cmdLine(ERRORS) || opts(HELP){
 		println(cmdLine(SUMMARY))
 	}else{
+		if opts(FUZZ) {
+			failures := fuzz.Run(opts(FUZZ), opts(SEED) || System::currentTimeMillis())
+			if failures > 0 {
+				println("\n", failures, "of", opts(FUZZ), "random programs crashed the compiler")
+				System::exit(1)
+			}
+		}
 		if not(seq(otherArgs)) {
-			println("Missing directory or file argument.")
-			printError(cmdLine)
+			if !opts(FUZZ) {
+				println("Missing directory or file argument.")
+				printError(cmdLine)
+			}
 		} else {
 			// file arguments
 			for arg := range otherArgs {
-				if file := io.file(arg); file->isDirectory {
-					compileTree(file, opts)
+				if opts(DECOMPILE) {
+					decompile.DecompileTree(io.file(arg))
 				} else {
-					try {
-						compileFile(file, here, opts)
-					} catch Exception e {
-						println("\n", e->getMessage())
+					if file := io.file(arg); file->isDirectory {
+						compileTree(file, opts)
+					} else {
+						try {
+							compileFile(file, here, opts)
+						} catch Exception e {
+							println("\n", e->getMessage())
+						}
 					}
 				}
 			}
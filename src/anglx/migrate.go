@@ -0,0 +1,255 @@
+//////
+// This file is part of the Funcgo compiler.
+//
+// Copyright (c) 2014 Eamonn O'Brien-Strain All rights
+// reserved. This program and the accompanying materials are made
+// available under the terms of the Eclipse Public License v1.0 which
+// accompanies this distribution, and is available at
+// http://www.eclipse.org/legal/epl-v10.html
+//
+// Contributors:
+// Eamonn O'Brien-Strain e@obrain.com - initial author
+//////
+
+// A tool that converts Funcgo source files to Anglx.  Short variable
+// declarations become Given declarations (or var at top level), for
+// loops become each loops, and if and switch with an initializer get
+// the given form.  Because Anglx only allows Given at the start of a
+// block, a declaration after other statements starts a new nested
+// block.  Anything that could not be converted is reported by line.
+
+package migrate
+import (
+	insta "instaparse/core"
+	"clojure/java/io"
+	"clojure/string"
+	"anglx/fmt"
+	"anglx/parser"
+)
+import type (
+	java.io.File
+	java.util.regex.{Matcher, Pattern}
+)
+
+// Rewrites of the start of a statement.  Each is a pattern matched
+// against the code with the literals masked, and a function of the
+// original text of its groups that returns the replacement.
+kRewrites := [
+	[
+		/^for\s+(.+?)\s*:=\s*(range|lazy|times)\b/,
+		func(destruct, kind) { str("each ", destruct, " in ", kind) }
+	],
+	[
+		/^for\s+([\p{L}_][\p{L}\p{Nd}_]*)\s*:=\s*(?=[^;]*;)/,
+		func(identifier) { str("each ", identifier, " = ") }
+	],
+	[
+		/^if\s+([^;{]+?)\s*:=\s*([^;{]+?)\s*;\s*/,
+		func(destruct, value) { str("if, given ", destruct, " is ", value, ", ") }
+	],
+	[
+		/^switch\s+([^;{]+?)\s*:=\s*([^;{]+?)\s*;\s*/,
+		func(destruct, value) { str("switch, given ", destruct, " is ", value, ", ") }
+	]
+]
+
+// The left-hand side of a short variable declaration: several
+// identifiers, an identifier with an optional type, or a destructuring
+// vector or map.
+kShortVarDecl := /^([\p{L}_][\p{L}\p{Nd}_]*(?:\s*,\s*[\p{L}_][\p{L}\p{Nd}_]*)+|[\p{L}_][\p{L}\p{Nd}_]*(?:\s+[\p{L}_][\p{L}\p{Nd}_.]*)?|\[[^\]]*\]|\{[^\}]*\})\s*:=\s*/
+
+// Left-hand sides that a top-level var declaration can take.
+kVarDecl := /[\p{L}_][\p{L}\p{Nd}_]*(\s*,\s*[\p{L}_][\p{L}\p{Nd}_]*|\s+[\p{L}_][\p{L}\p{Nd}_.]*)?/
+
+func matchStart(re Pattern, code String) {
+	m := re->matcher(code)
+	if m->lookingAt() { m } else { nil }
+}
+
+func groupTexts(m Matcher, text String) {
+	for g := lazy \`range`(1, m->groupCount() + 1) {
+		if m->start(int(g)) < 0 { nil } else { subs(text, m->start(int(g)), m->end(int(g))) }
+	}
+}
+
+// Return the replacement TEXT for the start of the statement and the
+// END of the text it replaces, or nil if the statement does not need
+// converting.  IS_GIVEN is true if the replacement is a Given
+// declaration, which is only allowed at the start of a block.
+func rewriteHead(body String, code String, isTopLevel) {
+	rewritten := some(func([re, replacement]) {
+		if m := matchStart(re, code); m {
+			{TEXT: apply(replacement, groupTexts(m, body)), END: m->end(), IS_GIVEN: false}
+		} else {
+			nil
+		}
+	}, kRewrites)
+	if rewritten {
+		rewritten
+	} else {
+		if m := matchStart(kShortVarDecl, code); m {
+			lhs := string.trim(first(groupTexts(m, body)))
+			switch {
+			case isTopLevel && reMatches(kVarDecl, lhs):
+				{TEXT: str("var ", lhs, " = "), END: m->end(), IS_GIVEN: false}
+			case !reFind(/^[\[\{]/, lhs) && lhs->contains(","):
+				{TEXT: str("Given ", lhs, " are "), END: m->end(), IS_GIVEN: !isTopLevel}
+			default:
+				{TEXT: str("Given ", lhs, " is "), END: m->end(), IS_GIVEN: !isTopLevel}
+			}
+		} else {
+			nil
+		}
+	}
+}
+
+// Push and pop the stack of open brackets for the brackets in the code
+// between the positions.  Return the new stack, and the positions before
+// which to insert the closing braces of blocks added for declarations.
+func scanBrackets(stack, code String, from, to, isSwitch) {
+	loop(stack = stack, inserts = [], pos = from) {
+		if pos >= to {
+			[stack, inserts]
+		} else {
+			c := code->charAt(pos)
+			switch {
+			case set{'(', '[', '{'}(c):
+				recur(stack  conj  {BRACKET: c, SEEN: false, EXTRA: 0, SWITCH: isSwitch && c == '{'},
+					inserts, pos + 1)
+			case set{')', ']', '}'}(c) && !isEmpty(stack): {
+				extra := EXTRA(peek(stack))
+				recur(pop(stack), if extra > 0 { inserts  conj  [pos, extra] } else { inserts }, pos + 1)
+			}
+			default:
+				recur(stack, inserts, pos + 1)
+			}
+		}
+	}
+}
+
+func insertBraces(text String, inserts) {
+	reduce(func(acc String, [pos, n]) {
+		str(subs(acc, 0, pos), string.join(repeat(n, "}")), subs(acc, pos))
+	}, text, reverse(sortBy(first, inserts)))
+}
+
+// Convert one line, given the stack of brackets open at its start.
+// Return the converted text, the problems found, and the stack at the
+// end of the line.
+func migrateLine(line String, code String, isLiteral, stack, lineNumber) {
+	leading  := if isLiteral { 0 } else { count(reFind(/^[ \t]*/, line)) }
+	indent   := subs(line, 0, leading)
+	body     := subs(line, leading)
+	bodyCode := subs(code, leading)
+	closers  := if isLiteral { 0 } else { count(reFind(/^[\)\]\}]*/, bodyCode)) }
+
+	[afterClosers, closerInserts] := scanBrackets(stack, bodyCode, 0, closers, false)
+	top         := peek(afterClosers)
+	isInBlock   := top && BRACKET(top) == '{'
+	isStatement := !isLiteral && closers == 0 && !string.isBlank(body) && !body->startsWith("//")
+	head        := if isStatement { rewriteHead(body, bodyCode, isEmpty(afterClosers)) } else { nil }
+	isGiven     := head && IS_GIVEN(head)
+
+	[framed, prefix, problems] := switch {
+	case isGiven && isInBlock && SWITCH(top):
+		[afterClosers, "", [[lineNumber, "declaration directly inside a case clause needs its own block"]]]
+	case isGiven && isInBlock && SEEN(top):
+		[
+			pop(afterClosers)  conj  (top  merge  {SEEN: false, EXTRA: EXTRA(top) + 1}),
+			str("{\n", indent),
+			[]
+		]
+	case isStatement && isInBlock && !isGiven:
+		[pop(afterClosers)  conj  assoc(top, SEEN, true), "", []]
+	default:
+		[afterClosers, "", []]
+	}
+
+	isSwitch       := reFind(/^(switch|select)\b/, bodyCode)
+	[after, inserts] := scanBrackets(framed, bodyCode, closers, count(bodyCode), isSwitch)
+	headEnd        := if head { END(head) } else { 0 }
+	delta          := if head { count(TEXT(head)) - headEnd } else { 0 }
+	shifted        := for [pos, n] := lazy concat(closerInserts, inserts) {
+		[if pos >= headEnd { pos + delta } else { pos }, n]
+	}
+	converted      := if head { TEXT(head)  str  subs(body, headEnd) } else { body }
+	unconverted    := switch {
+	case head || !isStatement:
+		[]
+	case bodyCode->contains(":="):
+		[[lineNumber, "short variable declaration not converted"]]
+	case reFind(/^for\b/, bodyCode):
+		[[lineNumber, "for loop not converted"]]
+	default:
+		[]
+	}
+	[
+		str(indent, prefix, insertBraces(converted, shifted)),
+		concat(problems, unconverted),
+		after
+	]
+}
+
+// The problem, if any, with parsing the converted source.
+func parseProblems(source String) {
+	parsed := parser.Parse(source)
+	if insta.isFailure(parsed) && insta.isFailure(parser.Parse(source, START, NONPKGFILE)) {
+		[[LINE(parsed), str("converted source does not parse, expected ",
+			string.join(", ", distinct(for r := lazy REASON(parsed) { prStr(EXPECTING(r)) })))]]
+	} else {
+		[]
+	}
+}
+
+// Convert Funcgo source text to Anglx.  Return a map with the Anglx
+// SOURCE and the PROBLEMS, a vector of [line, message] pairs describing
+// anything that could not be converted.
+func Migrate(text String) {
+	[masked, literalLines] := fmt.Mask(text)
+	lines     := string.split(text, /\n/, -1)
+	maskLines := string.split(masked, /\n/, -1)
+	[converted, problems] := loop(out = [], problems = [], stack = [], i = 0) {
+		if i == count(lines) {
+			[out, problems]
+		} else {
+			[line, lineProblems, after] := migrateLine(
+				lines[i], maskLines[i], literalLines(i), stack, i + 1)
+			recur(out  conj  line, problems  into  lineProblems, after, i + 1)
+		}
+	}
+	source := "\n"  string.join  converted
+	{SOURCE: source, PROBLEMS: problems  into  parseProblems(source)}
+}
+
+// Write the Anglx version of a .go or .gos Funcgo file next to it, as
+// a .anx or .anxs file respectively, printing any problems.  Return
+// the number of problems.
+func MigrateFile(inFile File) {
+	inPath  := inFile->getPath()
+	outFile := io.file(string.replace(inPath, /\.go(s?)$/, ".anx$1"))
+	println("  ", inPath, "...")
+	migrated := Migrate(slurp(inFile))
+	spit(outFile, SOURCE(migrated))
+	println("\t\t-->", outFile->getPath())
+	for [line, message] := range PROBLEMS(migrated) {
+		println(str(inPath, ":", line, ": ", message))
+	}
+	count(PROBLEMS(migrated))
+}
+
+// Entry point for the migration tool.  The arguments are Funcgo files
+// or directories containing them.
+func _main(args...) {
+	if isEmpty(args) {
+		println("USAGE:  anglx-migrate path ...")
+	} else {
+		sources := for f := lazy mapcat(func{fileSeq(io.file($1))}, args) if reFind(/\.gos?$/, str(f)) {
+			f
+		}
+		problems := reduce(+, 0, map(MigrateFile, sources))
+		println(problems, "problems")
+		if problems > 0 {
+			System::exit(1)
+		}
+	}
+}
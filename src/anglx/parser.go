@@ -16,16 +16,17 @@ package parser
 import insta "instaparse/core"
 
 whitespaceOrComments := insta.parser(`
-    ws-or-comments = #'(\s|(//[^\n]*\n))+'
+    ws-or-comments = #'(\s|(//[^\n]*\n)|((?<=\s)/\*[\s\S]*?\*/))+'
 `, NO_SLURP, true,  // for App Engine compatibility
 );
 
 var Parse = insta.parser(`
-sourcefile = packageclause (expressions|topwithconst|topwithassign)
+sourcefile = <#'/\*[\s\S]*?\*/'>? packageclause (expressions|topwithconst|topwithassign)
 nonpkgfile = (expressions|topwithconst|topwithassign) <NL>?
  packageclause = <#'\bpackage\b'> pkg <NL> importdecls
    pkg =  Identifier {<'/'> Identifier}
-   <NL> = #'\s*[;\n]\s*' | #'\s*//[^\n]*\n\s*'
+   <NL> = #'\s*[;\n](\s|/\*[\s\S]*?\*/)*' | #'\s*//[^\n]*\n(\s|/\*[\s\S]*?\*/)*'
+        | #'\s+/\*[\s\S]*?\*/[^\S\n]*\n(\s|/\*[\s\S]*?\*/)*'
    importdecls = {AnyImportDecl}
      <AnyImportDecl> = importdecl | macroimportdecl | externimportdecl | typeimportdecl | exclude
      exclude = <#'\bexclude\b' '('>
@@ -54,8 +55,10 @@ nonpkgfile = (expressions|topwithconst|topwithassign) <NL>?
  expressions = expr
               | expressions <NL> expr
    <expr>  = precedence00 | Vars | (*shortvardecl |*) ifelseexpr | letifelseexpr | tryexpr | forrange |
-                   forlazy | fortimes | forcstyle | Blocky | ExprSwitchStmt
-                     | functiondecl
+                   forlazy | fortimes | forcstyle | fornumeric | forloop | Blocky | ExprSwitchStmt
+                     | functiondecl | macrodecl | annotated | withopen | deferstmt
+                     | multidecl | methoddecl | derivedecl | receiverdecl | setfield
+                     | stateassign | rebind
 
 
      <Blocky> = block | withconst | withassign | loop
@@ -65,7 +68,7 @@ nonpkgfile = (expressions|topwithconst|topwithassign) <NL>?
          assigns = assign {<NL> assign}
            const  = Destruct <'='> expr
            assign = singleassign | multipleassign
-           multipleassign = <'Given'> Destruct <','> Destruct {<','> Destruct} 'are' expr <','> expr {<','> expr}
+           multipleassign = <'Given'> Destruct <','> Destruct {<','> Destruct} 'are' expr {<','> expr}
            singleassign = <'Given'> Destruct 'is' expr
 	     <Destruct> = Identifier | typedidentifier | vecdestruct | dictdestruct
 	       typedidentifiers = Identifier ({ <','> Identifier })? typename
@@ -87,7 +90,17 @@ nonpkgfile = (expressions|topwithconst|topwithassign) <NL>?
        topwithconst  =  <#'\bconst\b'> ( const | <'('> consts <')'> )  expressions
        topwithassign =  assigns <NL> expressions
      <ExprSwitchStmt> = boolswitch | constswitch | letconstswitch | typeswitch
-                        | selectstmtingo | selectstmt
+                        | selectstmtingo | selectstmt | matchstmt
+       matchstmt = <#'\bmatch\b'> expr <'{'> MatchClause {<NL> MatchClause} <'}'>
+         <MatchClause> = matchclause | matchdefault
+         matchclause = <#'\bcase\b'> MatchPattern ( matchguard )? <':'> expressions
+         matchdefault = <#'\bdefault\b' ':'> expressions
+           matchguard = <#'\bif\b'> expr
+           <MatchPattern> = label | BasicLit | vecpattern | dictpattern | !label Identifier
+             vecpattern = <'['> ( VecPatternElem {<','> VecPatternElem} )? <']'>
+               <VecPatternElem> = MatchPattern | variadicdestruct
+             dictpattern = <'{'> dictpatternelem {<','> dictpatternelem} <'}'>
+               dictpatternelem = MatchPattern <':'> expr
        selectstmt = <#'\bselect\b' '{'> (CommClause {<NL> CommClause})? <'}'>
          <CommClause> = sendclause | recvclause | recvvalclause | defaultclause
            sendclause       = <#'\bcase\b'> UnaryExpr        <    '<-'> UnaryExpr <':'> expressions?
@@ -120,9 +133,16 @@ nonpkgfile = (expressions|topwithconst|topwithassign) <NL>?
                 |'+'|!'->' '-'|bitor|bitxor
                 |'*'|'/'|mod|shiftleft|shiftright|bitand|bitandnot
                 |'+='|'-='
-     precedence00 = precedence0
-                 | precedence00 SendOp precedence0
+     precedence00 = Pipeline
+                 | precedence00 SendOp Pipeline
                  | assoc | dissoc | associn
+       <Pipeline> = precedence0 | pipe
+         pipe = precedence0 ( PipeOp precedence0 )+
+           <PipeOp> = threadlast | threadfirst | somethreadlast | somethreadfirst
+             threadlast      = <'|>'>
+             threadfirst     = <'|.>'>
+             somethreadlast  = <'|?>'>
+             somethreadfirst = <'|?.>'>
        assoc = precedence0 <'+=' '{'> associtem { <','> associtem } <'}'>
        dissoc = precedence0 <'-=' '{'> associtem { <','> associtem } <'}'>
 	 associtem = precedence0 <':'> precedence0
@@ -151,7 +171,7 @@ nonpkgfile = (expressions|topwithconst|topwithassign) <NL>?
                noteq  = <'!='>
 	     precedence4 = precedence5
                          | precedence4 addop precedence5
-	       addop = '+' | !'->' '-' | ( !or bitor ) | bitxor
+	       addop = '+' | !'->' '-' | ( !or !PipeOp bitor ) | bitxor
                  bitor = <'|'>
                  bitxor = <'^'>
 	       precedence5 = UnaryExpr
@@ -167,41 +187,83 @@ nonpkgfile = (expressions|topwithconst|topwithassign) <NL>?
                               | underscorejavaidentifier
                underscorejavaidentifier = #'\b_[\p{L}_][\p{L}_\p{Nd}]*\b'
 	   <Identifier> = !(Keyword | hexlit) (identifier | isidentifier | mutidentifier |
-			  escapedidentifier)
+			  escapedidentifier | gensymidentifier)
              Keyword = #'\bcase\b'
                      | #'\bconst\b'
+                     | #'\bdefer\b'
                      | #'\each\b'
                      | #'\bif\b'
                      | #'\bnew\b'
                      | #'\bpackage\b'
                    (*| #'\brange\b'*)
                      | #'\bselect\b'
+                     | #'\battempt\b'
+                     | #'\bderive\b'
+                     | #'\bdynamic\b'
+                     | #'\bensures\b'
+                     | #'\bmacro\b'
+                     | #'\bmatch\b'
+                     | #'\bmethod\b'
+                     | #'\bmulti\b'
+                     | #'\brebind\b'
+                     | #'\brequires\b'
+                     | #'\bwith\b'
 	     identifier = #'[\p{L}_[\p{S}&&[^\p{Punct}]]][\p{L}_[\p{S}&&[^\p{Punct}]]\p{Nd}]*'
 	     isidentifier = <#'\bis'> #'\p{L}' identifier         (* TODO(eob) make a regex *)
 	     mutidentifier = <#'\bmutate'> #'\p{L}' identifier    (* TODO(eob) make a regex *)
 	     escapedidentifier = #'\\[^\n\\]+\\'
+	     gensymidentifier = identifier <'#'>
      <Vars> = <#'\bvar\b'> ( <'('> VarDecl+ <')'> | VarDecl )
-     <VarDecl> = primarrayvardecl | arrayvardecl | vardecl1 | vardecl2
+     <VarDecl> = primarrayvardecl | arrayvardecl | vardecl1 | vardecl2 | statevardecl | dynamicvardecl
        primarrayvardecl = Identifier <'['> int_lit  <']'> primitivetype
        arrayvardecl = Identifier <'['> int_lit  <']'> typename
-       vardecl1 = Identifier ( typename )? <'='> expr
+       vardecl1 = Identifier ( !StateKind typename )? <'='> expr
        vardecl2 = Identifier  <','> Identifier ( typename )? <'='> precedence00 <','> precedence00
+       statevardecl = Identifier StateKind <'='> expr
+         <StateKind> = #'\batom\b' | #'\bref\b' | #'\bagent\b'
+       dynamicvardecl = <#'\bdynamic\b'> !StateKind Identifier ( typename )? <'='> expr
+     stateassign = Identifier <':='> expr
      ifelseexpr = <#'\bif\b'> expr Blocky ( <#'\belse\b'> Blocky )?
                 | <#'\bif\b'> expr <'then'> expr ( <#'\belse\b'> expr )?
      letifelseexpr = <#'\bif\b'> <','> <'given'> Destruct <'is'> expr <','>
                             expr Blocky ( <#'\belse\b'> Blocky )?
-     forrange = <#'\beach\b'> Destruct <'in' #'\brange\b'> expr (<'as'> expr | Blocky)
-     forlazy = <#'\beach\b'> Destruct <'in' #'\blazy\b'> expr
-               (<#'\bif\b'> expr )? (<'as'> expr | Blocky)
+     forrange = <#'\beach\b'> Destruct <'in' #'\brange\b'> expr {ForClause} (<'as'> expr | Blocky)
+     forlazy = <#'\beach\b'> Destruct <'in' #'\blazy\b'> expr {ForClause} (<'as'> expr | Blocky)
+       <ForClause> = <','> forbinding | forlet | forwhile | forwhen
+         forbinding = Destruct <'in'> ( <#'\blazy\b'> | <#'\brange\b'> )? expr
+         forlet     = <#'\bwhere\b'> Destruct <'is'> expr
+         forwhile   = <#'\bwhile\b'> expr
+         forwhen    = <#'\bif\b'> expr
      fortimes = <#'\beach\b'> Identifier <'in' #'\btimes\b'> expr (<'as'> expr | Blocky)
      forcstyle = <#'\beach\b'> Identifier <'=' '0' ';'>
                          Identifier <'<'> expr <';'>
                          Identifier <'++'>
                          (<'as'> expr | Blocky)
+     fornumeric = <#'\beach\b'> Identifier <'in'> expr ( #'\bto\b' | #'\buntil\b' ) expr
+                  ( <#'\bby\b'> expr )? (<'as'> expr | Blocky)
+     forloop = !forcstyle <#'\beach\b'> Identifier <'='> expr <';'> expr <';'> ForStep
+                         (<'as'> expr | Blocky)
+       <ForStep> = increment | decrement | stepadd | stepsub
+         increment = Identifier <'++'>
+         decrement = Identifier <'--'>
+         stepadd   = Identifier <'+='> expr
+         stepsub   = Identifier <'-='> expr
+     deferstmt = <#'\bdefer\b'> expr
+     multidecl = <#'\bmulti\b' #'\bfunc\b'> Identifier <'('> parameters <')'>
+                   <#'\bdispatch\b' #'\bby\b'> expr ( <#'\bin\b' #'\bhierarchy\b'> symbol )?
+     methoddecl = <#'\bmethod\b'> symbol <'('> ( methoddefault | !methoddefault expr ) <')'> Function
+       methoddefault = <#'\bdefault\b'>
+     derivedecl = <#'\bderive\b'> expr <#'\bfrom\b'> expr ( <#'\bin\b'> symbol )?
+     withopen = <#'\bwith\b'> ( withsingle | withmultiple ) ImpliedDo
+       withsingle   = Destruct 'is' expr
+       withmultiple = Destruct <','> Destruct {<','> Destruct} 'are' expr <','> expr {<','> expr}
+     rebind = <#'\brebind\b'> rebinding {<','> rebinding} ImpliedDo
+       rebinding = symbol <#'\bis\b'> expr
      tryexpr = <#'\btry\b'> ImpliedDo catches finally?
        catches = {catch}
          catch = <#'\bcatch\b'> typename Identifier ImpliedDo
        finally = <#'\bfinally\b'> ImpliedDo
+     attempt = <#'\battempt\b'> ImpliedDo
      <UnaryExpr> = unaryexpr  (* TODO(eob) remove this indirection *)
        unaryexpr = unary_op unaryexpr
                  | PrimaryExpr | javafield | ReaderMacro | prefixedblock
@@ -226,11 +288,15 @@ nonpkgfile = (expressions|topwithconst|topwithassign) <NL>?
                      | indexed
                      | dropslice
                      | takeslice
+                     | slice
+                     | attempt
+                     | checked
                                                                 (* Conversion |
                                                                 BuiltinCall |
                                                                 PrimaryExpr Selector |
                                                                 PrimaryExpr Slice |
                                                                 PrimaryExpr TypeAssertion | *)
+         checked = PrimaryExpr <'?'>
          prefixedroutine = prefix Routine
          prefixedblock   = prefix ImpliedDo
            prefix = asyncprefix | #'\bdosync\b'
@@ -246,6 +312,7 @@ nonpkgfile = (expressions|topwithconst|topwithassign) <NL>?
          indexed = PrimaryExpr <'['> expr <']'>
          takeslice = PrimaryExpr <'[' ':'> expr <']'>
          dropslice = PrimaryExpr <'['>  expr <':' ']'>
+         slice = PrimaryExpr <'['> expr <':'> expr <']'>
          variadiccall = PrimaryExpr
                            <'('> ( ArgumentList <','> )? Ellipsis PrimaryExpr <')'>
          functioncall = PrimaryExpr Call
@@ -253,14 +320,25 @@ nonpkgfile = (expressions|topwithconst|topwithassign) <NL>?
            len = <#'\blen\b'> Call
          javamethodcall = UnaryExpr <'->'> JavaIdentifier Call
            <Call> =  <'('> ArgumentList? <')'>
-             <ArgumentList> = expressionlist                                      (* [ Ellipsis ] *)
+             <ArgumentList> = expressionlist | namedargs                          (* [ Ellipsis ] *)
+               namedargs = ( expr <','> )* namedarg {<','> namedarg} ( <','>)?
+                 namedarg = Identifier <':'> expr
                expressionlist = expr { <','> expr} ( <','>)?
          <TypeDecl> = <#'\btype\b'> ( TypeSpec | <'('> {TypeSpec} <')'> )
-	   <TypeSpec> = interfacespec | structspec
+	   <TypeSpec> = interfacespec | structspec | valuestructspec
              structspec = JavaIdentifier <#'\bstruct\b' '{'> (fields )? <'}'>
                fields = Field
                         | fields <NL> Field
                  <Field> = Identifier | typedidentifiers
+             valuestructspec = JavaIdentifier <#'\bvalue\b' #'\bstruct\b' '{'> ( valuefields )? <'}'>
+                               { valueimpl }
+               valuefields = ValueField {<NL> ValueField}
+                 <ValueField> = mutablefield | volatilefield | !#'\b(mutable|volatile)\b' Field
+                   mutablefield  = <#'\bmutable\b'> Field
+                   volatilefield = <#'\bvolatile\b'> Field
+               valueimpl = <#'\bimplements\b'> typename (
+                             MethodImpl | <'('>  MethodImpl {<NL> MethodImpl}   <')'>
+                           )
 	     interfacespec = JavaIdentifier <#'\binterface\b' '{'> {MethodSpec} <'}'>
 	       <MethodSpec> = voidmethodspec | typedmethodspec
 	       voidmethodspec = Identifier <'('> methodparameters? <')'>
@@ -277,17 +355,36 @@ nonpkgfile = (expressions|topwithconst|topwithassign) <NL>?
              typedmethodimpl = Identifier <'('>  parameters? <')'> typename
                                    (ReturnBlock|Blocky)
          functiondecl = <#'\bfunc\b'> (Identifier|operator) Function
+         macrodecl = <#'\bmacro\b' #'\bfunc\b'> Identifier Function
+         annotated = annotation {annotation}
+                       ( functiondecl | macrodecl | <#'\bvar\b'> (vardecl1 | vardecl2 | statevardecl | dynamicvardecl) )
+           annotation = <'@'> ( Identifier | &Keyword identifier ) ( <'('> expr <')'> )?
+         setfield = <#'\bset\b'> Identifier <'='> expr
+         receiverdecl = <#'\bfunc\b' '('> receiver <')'> JavaIdentifier receiverparams
+                          ( typename )? (ReturnBlock|Blocky)
+           receiver = Identifier <'*'>? typename
+           receiverparams = <'('> ( parameters | parameters <','> variadic | variadic )? <')'>
          funclikedecl = <#'\bfunc\b' '<'> symbol <'>'> Identifier Function
            <Function> = FunctionPart | functionparts
              functionparts = FunctionPart FunctionPart { FunctionPart}
                <FunctionPart> = functionpart0 | functionpartn | vfunctionpart0 | vfunctionpartn
-                 functionpart0 = <'(' ')'>  ( typename )? (ReturnBlock|Blocky)
-		 vfunctionpart0 = <'('> variadic <')'> ( typename )? (ReturnBlock|Blocky)
-		 functionpartn  = <'('> parameters <')'> ( typename )? (ReturnBlock|Blocky)
-		 vfunctionpartn = <'('> parameters  <','> variadic <')'> ( typename )?
+                              | kwfunctionpart
+                 functionpart0 = <'(' ')'>  ( typename )? conditions? (ReturnBlock|Blocky)
+		 vfunctionpart0 = <'('> variadic <')'> ( typename )? conditions? (ReturnBlock|Blocky)
+		 functionpartn  = <'('> parameters <')'> ( typename )? conditions? (ReturnBlock|Blocky)
+		 vfunctionpartn = <'('> parameters  <','> variadic <')'> ( typename )? conditions?
+                                 (ReturnBlock|Blocky)
+		 kwfunctionpart = <'('> ( parameters <','> )? defaultparams <')'> ( typename )? conditions?
                                  (ReturnBlock|Blocky)
                    parameters = Destruct {<','> Destruct}
+                   defaultparams = DefaultParam {<','> DefaultParam}
+                     <DefaultParam> = positionaldefault | nameddefault
+                       positionaldefault = Identifier <'='> expr
+                       nameddefault      = Identifier <':'> expr
                    variadic = Identifier Ellipsis
+                   conditions = precondition postcondition? | postcondition
+                     precondition  = <#'\brequires\b'> expr {<','> expr}
+                     postcondition = <#'\bensures\b'> expr {<','> expr}
                    <ReturnBlock> = <'{' #'\breturn\b'> expr <'}'>
          <Operand> = Literal | OperandName | label | islabel | new  | <'('> expr <')'> (*|MethodExpr*)
            label = #'\b\p{Lu}[\p{Lu}_\p{Nd}#\.]*\b'
@@ -71,6 +71,28 @@ func TypeCreated(st, typ) {
 	//}
 }
 
+// Add a multimethod symbol to the table.
+func MultiCreated(st, name) {
+	dosync(st  alter  func{$1 += {
+		name: MULTI
+	}})
+}
+
+// Add the signature of a function with default parameters to the table.
+func SignatureCreated(st, name, signature) {
+	dosync(st  alter  func{$1 += {
+		SIGNATURES: get($1, SIGNATURES, {}) += {name: signature}
+	}})
+}
+
+// Add a var declared in this file to the table, noting whether it is
+// dynamic.
+func VarCreated(st, name, isDynamic) {
+	dosync(st  alter  func{$1 += {
+		name: if isDynamic { DYNAMIC } else { VAR }
+	}})
+}
+
 // Has this package been previously been added to the table?
 func HasPackage(st, pkg) {
 	dosync(st  alter  func{$1 += {
@@ -87,6 +109,22 @@ func HasType(st, typ) {
 	(*st)(typ) == TYPE
 }
 
+// Has this multimethod been previously been added to the table?
+func HasMulti(st, name) {
+	(*st)(name) == MULTI
+}
+
+// Has this var been declared in this file without being dynamic?
+func IsStaticVar(st, name) {
+	(*st)(name) == VAR
+}
+
+// Return the signature of the function with default parameters, or
+// nil if there is none in the table.
+func Signature(st, name) {
+	get((*st)(SIGNATURES), name)
+}
+
 // Return a string representation of packages in the table.
 func Packages(st) {
 	const packages = for [symbol, key] := lazy *st if key == PACKAGE { symbol }